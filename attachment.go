@@ -0,0 +1,300 @@
+package blest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// partKey marks a placeholder for a binary part of a multipart batch,
+// {"$part": "<name>"}, which is replaced by the part as an *Attachment.
+const partKey = "$part"
+
+// batchPartName is the name of the part that holds the batch itself.
+const batchPartName = "batch"
+
+const (
+	multipartFormType  = "multipart/form-data"
+	multipartMixedType = "multipart/mixed"
+)
+
+// Attachment is binary content sent alongside a batch, either in the body of
+// a request or in the result of a route. Bodies and results may hold
+// attachments anywhere a value is allowed, and handlers read them as an
+// io.Reader. Clients that cannot receive multipart responses get the content
+// inline instead, as a base64 string in JSON and as binary in MessagePack and
+// CBOR.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	mu          sync.Mutex
+	reader      io.Reader
+	data        []byte
+	buffered    bool
+}
+
+func NewAttachment(reader io.Reader, contentType string, filename string) *Attachment {
+	if reader == nil {
+		panic("Attachment reader is required")
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &Attachment{Filename: filename, ContentType: contentType, reader: reader}
+}
+
+func newBufferedAttachment(data []byte, contentType string, filename string) *Attachment {
+	attachment := NewAttachment(bytes.NewReader(data), contentType, filename)
+	attachment.data, attachment.buffered = data, true
+	return attachment
+}
+
+func (a *Attachment) Read(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reader.Read(p)
+}
+
+// Bytes reads the rest of the attachment and keeps it, so that it can be
+// sent again, and read again from the start.
+func (a *Attachment) Bytes() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.buffered {
+		data, err := io.ReadAll(a.reader)
+		if err != nil {
+			return nil, err
+		}
+		a.data, a.buffered = data, true
+	}
+	a.reader = bytes.NewReader(a.data)
+	return a.data, nil
+}
+
+func (a *Attachment) MarshalJSON() ([]byte, error) {
+	data, err := a.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(data)
+}
+
+func (a *Attachment) MarshalMsgpack() ([]byte, error) {
+	data, err := a.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(data)
+}
+
+func (a *Attachment) MarshalCBOR() ([]byte, error) {
+	data, err := a.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(data)
+}
+
+func hasAttachments(value interface{}) bool {
+	switch v := value.(type) {
+	case *Attachment:
+		return true
+	case map[string]interface{}:
+		for _, item := range v {
+			if hasAttachments(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if hasAttachments(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extractParts copies a value, replacing every attachment with a placeholder
+// for a part named after its position in parts.
+func extractParts(value interface{}, parts *[]*Attachment) interface{} {
+	switch v := value.(type) {
+	case *Attachment:
+		*parts = append(*parts, v)
+		return map[string]interface{}{partKey: strconv.Itoa(len(*parts) - 1)}
+	case map[string]interface{}:
+		extracted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			extracted[key] = extractParts(item, parts)
+		}
+		return extracted
+	case []interface{}:
+		extracted := make([]interface{}, len(v))
+		for i, item := range v {
+			extracted[i] = extractParts(item, parts)
+		}
+		return extracted
+	}
+	return value
+}
+
+// resolveParts replaces every placeholder in a value with its part.
+func resolveParts(value interface{}, parts map[string]*Attachment) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if name, ok := v[partKey].(string); ok && len(v) == 1 {
+			attachment, exists := parts[name]
+			if !exists {
+				return nil, fmt.Errorf("Part %q is missing from the batch", name)
+			}
+			return attachment, nil
+		}
+		for key, item := range v {
+			resolved, err := resolveParts(item, parts)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = resolved
+		}
+	case []interface{}:
+		for i, item := range v {
+			resolved, err := resolveParts(item, parts)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+	}
+	return value, nil
+}
+
+// writeMultipart encodes a batch, or the results of one, followed by the
+// attachments it refers to.
+func writeMultipart(mediaType string, batchContentType string, batch []byte, parts []*Attachment) ([]byte, string, error) {
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	disposition := "form-data"
+	if mediaType != multipartFormType {
+		disposition = "attachment"
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"name": batchPartName}))
+	header.Set("Content-Type", batchContentType)
+	part, err := writer.CreatePart(header)
+	if err == nil {
+		_, err = part.Write(batch)
+	}
+	for i, attachment := range parts {
+		if err != nil {
+			break
+		}
+		var data []byte
+		data, err = attachment.Bytes()
+		if err != nil {
+			break
+		}
+		params := map[string]string{"name": strconv.Itoa(i)}
+		if attachment.Filename != "" {
+			params["filename"] = attachment.Filename
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+		header.Set("Content-Type", attachment.ContentType)
+		part, err = writer.CreatePart(header)
+		if err == nil {
+			_, err = part.Write(data)
+		}
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buffer.Bytes(), mime.FormatMediaType(mediaType, map[string]string{"boundary": writer.Boundary()}), nil
+}
+
+// readMultipart decodes a multipart batch into the batch part, its content
+// type, and the other parts by name.
+func readMultipart(body []byte, boundary string) ([]byte, string, map[string]*Attachment, error) {
+	if boundary == "" {
+		return nil, "", nil, errors.New("multipart boundary is missing")
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var batch []byte
+	batchContentType := "application/json"
+	parts := make(map[string]*Attachment)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", nil, err
+		}
+		_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		contentType := part.Header.Get("Content-Type")
+		if params["name"] == batchPartName {
+			batch = data
+			if contentType != "" {
+				batchContentType = contentType
+			}
+			continue
+		}
+		parts[params["name"]] = newBufferedAttachment(data, contentType, params["filename"])
+	}
+	if batch == nil {
+		return nil, "", nil, errors.New("batch part is missing")
+	}
+	return batch, batchContentType, parts, nil
+}
+
+// acceptsMultipart reports whether a client can receive results with their
+// attachments as separate parts.
+func acceptsMultipart(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == multipartMixedType {
+			return true
+		}
+	}
+	return false
+}
+
+func resultHasAttachments(result [][4]interface{}) bool {
+	for _, item := range result {
+		if hasAttachments(item[2]) {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalMultipartResult encodes the results of a batch with their
+// attachments as separate parts.
+func marshalMultipartResult(codec Codec, result [][4]interface{}) ([]byte, string, error) {
+	var parts []*Attachment
+	extracted := make([][4]interface{}, len(result))
+	for i, item := range result {
+		extracted[i] = item
+		extracted[i][2] = extractParts(item[2], &parts)
+	}
+	batch, err := codec.Marshal(extracted)
+	if err != nil {
+		return nil, "", err
+	}
+	return writeMultipart(multipartMixedType, codec.ContentType(), batch, parts)
+}
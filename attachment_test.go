@@ -0,0 +1,100 @@
+package blest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachments(t *testing.T) {
+	t.Parallel()
+
+	binary := []byte("binary\x00data\xff")
+	router := NewRouter()
+	router.Route("upload", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		file, ok := body["file"].(io.Reader)
+		if !ok {
+			return nil, NewBlestError("File is required", 400)
+		}
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		attachment := body["file"].(*Attachment)
+		return map[string]interface{}{"size": len(data), "filename": attachment.Filename, "contentType": attachment.ContentType, "name": body["name"]}, nil
+	})
+	router.Route("download", func() (interface{}, error) {
+		return map[string]interface{}{"file": NewAttachment(bytes.NewReader(binary), "image/png", "a.png")}, nil
+	})
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+
+	// Attachments in request bodies are uploaded as parts and read by
+	// handlers as readers
+	client := NewHttpClient(server.URL)
+	upload := NewAttachment(strings.NewReader("hello world"), "text/plain", "hello.txt")
+	result, err := client.Request("upload", map[string]interface{}{"file": upload, "name": "greeting"})
+	assert.Nil(t, err)
+	assert.Equal(t, 11.0, result["size"])
+	assert.Equal(t, "hello.txt", result["filename"])
+	assert.Equal(t, "text/plain", result["contentType"])
+	assert.Equal(t, "greeting", result["name"])
+
+	// Attachments in results come back as parts
+	result, err = client.Request("download")
+	assert.Nil(t, err)
+	download := result["file"].(*Attachment)
+	data, err := io.ReadAll(download)
+	assert.Nil(t, err)
+	assert.Equal(t, binary, data)
+	assert.Equal(t, "image/png", download.ContentType)
+	assert.Equal(t, "a.png", download.Filename)
+
+	// Clients that do not accept multipart responses get base64 strings
+	response, err := http.Post(server.URL, "application/json", strings.NewReader(`[["1","download"]]`))
+	assert.Nil(t, err)
+	defer response.Body.Close()
+	var plain [][]interface{}
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&plain))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(binary), plain[0][2].(map[string]interface{})["file"])
+
+	// as well as binary content in the other codecs
+	for _, codec := range []Codec{MsgpackCodec{}, CBORCodec{}} {
+		encoded, err := codec.Marshal(map[string]interface{}{"file": NewAttachment(bytes.NewReader(binary), "image/png", "a.png")})
+		assert.Nil(t, err)
+		var decoded map[string][]byte
+		assert.Nil(t, codec.Unmarshal(encoded, &decoded))
+		assert.Equal(t, binary, decoded["file"], codec.ContentType())
+	}
+
+	// Placeholders should refer to parts of the batch
+	body, contentType, err := writeMultipart(multipartFormType, "application/json", []byte(`[["1","upload",{"file":{"$part":"9"}}]]`), nil)
+	assert.Nil(t, err)
+	response, err = http.Post(server.URL, contentType, bytes.NewReader(body))
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	response, err = http.Post(server.URL, mime.FormatMediaType(multipartFormType, map[string]string{"boundary": "x"}), strings.NewReader("--x--"))
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	// Attachments can be read again once buffered
+	attachment := NewAttachment(strings.NewReader("abc"), "", "")
+	assert.Equal(t, "application/octet-stream", attachment.ContentType)
+	first, _ := attachment.Bytes()
+	second, _ := io.ReadAll(attachment)
+	assert.Equal(t, first, second)
+	assert.Panics(t, func() {
+		NewAttachment(nil, "", "")
+	})
+}
@@ -0,0 +1,217 @@
+package blest
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// EndpointHealth describes the circuit breaker of a single endpoint.
+type EndpointHealth struct {
+	Url                 string
+	State               string
+	InFlight            int
+	ConsecutiveFailures int
+	LastError           error
+}
+
+type endpoint struct {
+	url       string
+	transport Transport
+	state     string
+	inFlight  int
+	failures  int
+	openedAt  time.Time
+	lastError error
+}
+
+// BalancedTransport spreads batches across several endpoints, either in turn
+// or to the one with the fewest batches in flight. An endpoint that fails
+// failureThreshold batches in a row is ejected for resetTimeout, after which
+// a single batch is let through to probe it.
+type BalancedTransport struct {
+	mu               sync.Mutex
+	endpoints        []*endpoint
+	leastInFlight    bool
+	next             int
+	failureThreshold int
+	resetTimeout     time.Duration
+}
+
+func NewBalancedTransport(urls []string, args ...interface{}) *BalancedTransport {
+	var options map[string]interface{}
+	if len(args) > 0 {
+		o, oOk := args[0].(map[string]interface{})
+		if oOk {
+			options = o
+		}
+	}
+	if len(urls) == 0 {
+		panic("At least one URL is required")
+	}
+	leastInFlight := false
+	if options["strategy"] != nil {
+		switch options["strategy"] {
+		case "roundRobin":
+		case "leastInFlight":
+			leastInFlight = true
+		default:
+			panic("Strategy should be roundRobin or leastInFlight")
+		}
+	}
+	failureThreshold := 5
+	if options["failureThreshold"] != nil {
+		f, ok := options["failureThreshold"].(int)
+		if !ok || f <= 0 {
+			panic("Failure threshold should be a positive integer")
+		}
+		failureThreshold = f
+	}
+	resetTimeout := 30 * time.Second
+	if options["resetTimeout"] != nil {
+		r, ok := options["resetTimeout"].(int)
+		if !ok || r <= 0 {
+			panic("Reset timeout should be a positive integer")
+		}
+		resetTimeout = time.Duration(r) * time.Millisecond
+	}
+	t := &BalancedTransport{
+		leastInFlight:    leastInFlight,
+		failureThreshold: failureThreshold,
+		resetTimeout:     resetTimeout,
+	}
+	for _, url := range urls {
+		t.endpoints = append(t.endpoints, &endpoint{
+			url:       url,
+			transport: NewHttpTransport(url, options),
+			state:     CircuitClosed,
+		})
+	}
+	return t
+}
+
+// acquire picks an endpoint for a batch, or returns nil when every circuit
+// is open. An open circuit whose reset timeout has passed is half-opened for
+// the batch, which becomes its probe.
+func (t *BalancedTransport) acquire() *endpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var chosen *endpoint
+	chosenIndex := 0
+	for i := 0; i < len(t.endpoints); i++ {
+		index := (t.next + i) % len(t.endpoints)
+		e := t.endpoints[index]
+		available := e.state == CircuitClosed || (e.state == CircuitOpen && now.Sub(e.openedAt) >= t.resetTimeout)
+		if !available {
+			continue
+		}
+		if chosen == nil || (t.leastInFlight && e.inFlight < chosen.inFlight) {
+			chosen, chosenIndex = e, index
+		}
+		if !t.leastInFlight {
+			break
+		}
+	}
+	if chosen == nil {
+		return nil
+	}
+	// The rotation continues after the chosen endpoint, so that the one
+	// after a skipped circuit does not take its turn as well
+	t.next = chosenIndex + 1
+	if chosen.state == CircuitOpen {
+		chosen.state = CircuitHalfOpen
+	}
+	chosen.inFlight++
+	return chosen
+}
+
+// release records the outcome of a batch. Only server errors and batches
+// that got no response count as failures.
+func (t *BalancedTransport) release(e *endpoint, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e.inFlight--
+	failed := err != nil
+	if blestErr, ok := err.(*BlestError); ok {
+		failed = blestErr.StatusCode >= 500
+	}
+	if !failed {
+		e.state = CircuitClosed
+		e.failures = 0
+		return
+	}
+	e.failures++
+	e.lastError = err
+	if e.state == CircuitHalfOpen || e.failures >= t.failureThreshold {
+		e.state = CircuitOpen
+		e.openedAt = time.Now()
+	}
+}
+
+func errNoHealthyEndpoints() error {
+	return &BlestError{Message: "No healthy endpoints", StatusCode: 503, Code: "NO_HEALTHY_ENDPOINTS"}
+}
+
+func (t *BalancedTransport) Send(requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	e := t.acquire()
+	if e == nil {
+		return errNoHealthyEndpoints()
+	}
+	err := e.transport.Send(requests, headers, respond)
+	t.release(e, err)
+	return err
+}
+
+func (t *BalancedTransport) subscribe(ctx context.Context, requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	e := t.acquire()
+	if e == nil {
+		return errNoHealthyEndpoints()
+	}
+	transport, ok := e.transport.(subscribeTransport)
+	if !ok {
+		t.release(e, nil)
+		return errSubscriptionsUnsupported
+	}
+	err := transport.subscribe(ctx, requests, headers, respond)
+	if ctx.Err() != nil {
+		err = nil
+	}
+	t.release(e, err)
+	return err
+}
+
+func (t *BalancedTransport) Health() []EndpointHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health := make([]EndpointHealth, len(t.endpoints))
+	for i, e := range t.endpoints {
+		health[i] = EndpointHealth{
+			Url:                 e.url,
+			State:               e.state,
+			InFlight:            e.inFlight,
+			ConsecutiveFailures: e.failures,
+			LastError:           e.lastError,
+		}
+	}
+	return health
+}
+
+// Health reports the state of every endpoint when the client balances
+// batches across several URLs, and nil otherwise.
+func (c *HttpClient) Health() []EndpointHealth {
+	transport := c.transport
+	if retry, ok := transport.(*retryTransport); ok {
+		transport = retry.transport
+	}
+	if balanced, ok := transport.(*BalancedTransport); ok {
+		return balanced.Health()
+	}
+	return nil
+}
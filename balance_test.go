@@ -0,0 +1,159 @@
+package blest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testEndpoint struct {
+	server  *httptest.Server
+	hits    atomic.Int32
+	failing atomic.Bool
+	delay   time.Duration
+}
+
+func newTestEndpoint(router *Router, delay time.Duration) *testEndpoint {
+	e := &testEndpoint{delay: delay}
+	handler := router.HttpHandler()
+	e.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.hits.Add(1)
+		if e.failing.Load() {
+			writeHttpError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "Internal Server Error")
+			return
+		}
+		time.Sleep(e.delay)
+		handler.ServeHTTP(w, r)
+	}))
+	return e
+}
+
+func TestBalancedTransport(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter()
+	router.Route("ping", func() (interface{}, error) {
+		return map[string]interface{}{"pong": true}, nil
+	})
+
+	endpoints := []*testEndpoint{newTestEndpoint(router, 0), newTestEndpoint(router, 0), newTestEndpoint(router, 0)}
+	urls := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		defer e.server.Close()
+		urls[i] = e.server.URL
+	}
+
+	client := NewHttpClient("", map[string]interface{}{
+		"urls":             urls,
+		"failureThreshold": 2,
+		"resetTimeout":     100,
+		"maxAttempts":      3,
+		"retryDelay":       1,
+		"idempotentRoutes": []string{"ping"},
+	})
+
+	// Batches are spread evenly
+	for i := 0; i < 6; i++ {
+		_, err := client.Request("ping")
+		assert.Nil(t, err)
+	}
+	for _, e := range endpoints {
+		assert.Equal(t, int32(2), e.hits.Load())
+	}
+
+	// A failing endpoint is ejected after two failures, and retries go on to
+	// the healthy ones
+	endpoints[0].failing.Store(true)
+	for i := 0; i < 6; i++ {
+		_, err := client.Request("ping")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(4), endpoints[0].hits.Load())
+	health := client.Health()
+	assert.Equal(t, CircuitOpen, health[0].State)
+	assert.Equal(t, 2, health[0].ConsecutiveFailures)
+	assert.Equal(t, 500, health[0].LastError.(*BlestError).StatusCode)
+	assert.Equal(t, CircuitClosed, health[1].State)
+
+	// The healthy endpoints share the batches evenly while it is ejected
+	before := []int32{endpoints[1].hits.Load(), endpoints[2].hits.Load()}
+	for i := 0; i < 6; i++ {
+		client.Request("ping")
+	}
+	assert.Equal(t, int32(4), endpoints[0].hits.Load())
+	assert.Equal(t, before[0]+3, endpoints[1].hits.Load())
+	assert.Equal(t, before[1]+3, endpoints[2].hits.Load())
+
+	// After the reset timeout a single probe half-opens the circuit, and a
+	// failed probe opens it again
+	time.Sleep(120 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		client.Request("ping")
+	}
+	assert.Equal(t, int32(5), endpoints[0].hits.Load())
+	assert.Equal(t, CircuitOpen, client.Health()[0].State)
+
+	endpoints[0].failing.Store(false)
+	time.Sleep(120 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		client.Request("ping")
+	}
+	assert.Equal(t, CircuitClosed, client.Health()[0].State)
+	assert.Equal(t, 0, client.Health()[0].ConsecutiveFailures)
+
+	// With every circuit open, batches fail without being sent
+	for _, e := range endpoints {
+		e.failing.Store(true)
+	}
+	for i := 0; i < 3; i++ {
+		client.Request("ping")
+	}
+	_, err := client.Request("ping")
+	assert.Equal(t, "NO_HEALTHY_ENDPOINTS", err.(*BlestError).Code)
+
+	assert.Nil(t, NewHttpClient("http://localhost").Health())
+	assert.Panics(t, func() {
+		NewBalancedTransport(nil)
+	})
+	assert.Panics(t, func() {
+		NewBalancedTransport(urls, map[string]interface{}{"strategy": "random"})
+	})
+}
+
+func TestLeastInFlight(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter()
+	router.Route("ping", func() (interface{}, error) {
+		return map[string]interface{}{"pong": true}, nil
+	})
+
+	slow := newTestEndpoint(router, 200*time.Millisecond)
+	fast := newTestEndpoint(router, 0)
+	defer slow.server.Close()
+	defer fast.server.Close()
+
+	transport := NewBalancedTransport([]string{slow.server.URL, fast.server.URL}, map[string]interface{}{"strategy": "leastInFlight"})
+
+	// The slow endpoint keeps its batch in flight, so the rest go elsewhere
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		transport.Send([][]interface{}{{"a", "ping"}}, nil, func([]interface{}) {})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, transport.Health()[0].InFlight)
+	for i := 0; i < 5; i++ {
+		err := transport.Send([][]interface{}{{"b", "ping"}}, nil, func([]interface{}) {})
+		assert.Nil(t, err)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), slow.hits.Load())
+	assert.Equal(t, int32(5), fast.hits.Load())
+}
@@ -0,0 +1,127 @@
+package blest
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var errBatchSent = errors.New("batch already sent")
+
+// Future is the eventual result of a single call added to a Batch.
+type Future struct {
+	id     string
+	done   chan struct{}
+	result map[string]interface{}
+	err    error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) resolve(result map[string]interface{}, err error) {
+	f.result, f.err = result, err
+	close(f.done)
+}
+
+// Ref returns a placeholder for the value at path in the result of the call,
+// which a later call in the same batch can use in its body. The server
+// replaces it before running that call, and fails that call when this one
+// fails.
+func (f *Future) Ref(path string) map[string]interface{} {
+	return Ref(f.id, path)
+}
+
+// Done is closed once the result of the call is known.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the batch has been sent and returns the result of the
+// call.
+func (f *Future) Wait() (map[string]interface{}, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+// Batch collects calls that are sent together as a single request, whatever
+// the client's maximum batch size. Batch interceptors run for the request as
+// a whole, but request interceptors do not run for its calls.
+type Batch struct {
+	client   *HttpClient
+	mu       sync.Mutex
+	requests [][]interface{}
+	futures  map[string]*Future
+	sent     bool
+}
+
+// Batch returns an empty batch that is sent with the client's transport.
+func (c *HttpClient) Batch() *Batch {
+	return &Batch{client: c, futures: make(map[string]*Future)}
+}
+
+// Add queues a call in the batch, taking the same arguments as Request. A
+// call with invalid arguments, or one added after the batch was sent, fails
+// at once.
+func (b *Batch) Add(route string, args ...interface{}) *Future {
+	future := newFuture()
+	body, headers, err := parseRequestArgs(route, args)
+	if err != nil {
+		future.resolve(nil, err)
+		return future
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sent {
+		future.resolve(nil, errBatchSent)
+		return future
+	}
+	future.id = uuid.New().String()
+	b.requests = append(b.requests, []interface{}{future.id, route, body, headers})
+	b.futures[future.id] = future
+	return future
+}
+
+// Send sends every call in the batch as one request and resolves their
+// futures. When the request fails, the error is returned and given to every
+// call that got no result.
+func (b *Batch) Send() error {
+	b.mu.Lock()
+	if b.sent {
+		b.mu.Unlock()
+		return errBatchSent
+	}
+	b.sent = true
+	requests := b.requests
+	b.mu.Unlock()
+	if len(requests) == 0 {
+		return nil
+	}
+
+	var mu sync.Mutex
+	err := b.client.send(requests, func(r []interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		id := r[0].(string)
+		future, ok := b.futures[id]
+		if !ok {
+			return
+		}
+		delete(b.futures, id)
+		future.resolve(itemResult(r[2], r[3]))
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	for id, future := range b.futures {
+		if err != nil {
+			future.resolve(nil, err)
+		} else {
+			future.resolve(nil, errors.New("no response for "+id))
+		}
+	}
+	b.futures = nil
+	return err
+}
@@ -0,0 +1,80 @@
+package blest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter()
+	router.Route("double", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		n, _ := body["n"].(float64)
+		return map[string]interface{}{"n": n * 2}, nil
+	})
+
+	var posts atomic.Int32
+	handler := router.HttpHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// Every call shares one request, even past the maximum batch size
+	client := NewHttpClient(server.URL)
+	client.MaxBatchSize = 1
+	var sizes []int
+	client.Use(func(requests [][]interface{}, headers map[string]string, next func([][]interface{}, map[string]string) error) error {
+		sizes = append(sizes, len(requests))
+		return next(requests, headers)
+	})
+	batch := client.Batch()
+	one := batch.Add("double", map[string]interface{}{"n": 1.0})
+	two := batch.Add("double", map[string]interface{}{"n": 2.0})
+	missing := batch.Add("missing")
+	invalid := batch.Add("")
+	select {
+	case <-one.Done():
+		t.Fatal("future resolved before the batch was sent")
+	default:
+	}
+	_, err := invalid.Wait()
+	assert.EqualError(t, err, "route is required")
+
+	assert.Nil(t, batch.Send())
+	assert.Equal(t, int32(1), posts.Load())
+	assert.Equal(t, []int{3}, sizes)
+	result, err := one.Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, result["n"])
+	result, err = two.Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, 4.0, result["n"])
+	_, err = missing.Wait()
+	assert.Equal(t, 404, err.(*BlestError).StatusCode)
+
+	// A batch is sent only once
+	_, err = batch.Add("double").Wait()
+	assert.Equal(t, errBatchSent, err)
+	assert.Equal(t, errBatchSent, batch.Send())
+	assert.Nil(t, client.Batch().Send())
+	assert.Equal(t, int32(1), posts.Load())
+
+	// A failed request fails every call
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	batch = NewHttpClient(closed.URL).Batch()
+	futures := []*Future{batch.Add("double"), batch.Add("double")}
+	sendErr := batch.Send()
+	assert.NotNil(t, sendErr)
+	for _, future := range futures {
+		_, err := future.Wait()
+		assert.Equal(t, sendErr, err)
+	}
+}
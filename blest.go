@@ -2,18 +2,24 @@ package blest
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
 type RequestHandler func(requests [][]interface{}, context map[string]interface{}) ([][4]interface{}, map[string]interface{})
@@ -26,25 +32,32 @@ type requestObject struct {
 }
 
 type eventEmitter struct {
+	mu     sync.Mutex
 	events map[string][]chan interface{}
 }
 
 type Router struct {
-	Options       map[string]interface{}
-	Introspection bool
-	Middleware    []interface{}
-	Afterware     []interface{}
-	Timeout       int
-	Routes        map[string]Route
+	Options          map[string]interface{}
+	Introspection    bool
+	Middleware       []interface{}
+	Afterware        []interface{}
+	Timeout          int
+	Routes           map[string]Route
+	limits           requestLimits
+	idempotency      IdempotencyStore
+	idempotencyScope IdempotencyScope
 }
 
 type Route struct {
-	Handler     []interface{}
-	Description string
-	Schema      interface{}
-	Visible     bool
-	Validate    bool
-	Timeout     int
+	Handler      []interface{}
+	Description  string
+	Schema       interface{}
+	Visible      bool
+	Validate     bool
+	Timeout      int
+	Subscription SubscriptionHandler
+	Cacheable    bool
+	MaxAge       int
 }
 
 type HttpClient struct {
@@ -55,6 +68,15 @@ type HttpClient struct {
 	Queue        [][]interface{}
 	Timeout      *time.Timer
 	Emitter      *eventEmitter
+	mu           sync.Mutex
+	transport    Transport
+
+	requestTimeout      time.Duration
+	requestInterceptors []RequestInterceptor
+	batchInterceptors   []BatchInterceptor
+	calls               *callGroup
+	offline             *offlineQueue
+	notifications       map[string]chan error
 }
 
 type BlestError struct {
@@ -115,17 +137,15 @@ func isLetterOrNumber(char byte) bool {
 }
 
 func NewBlestError(message string, args ...interface{}) error {
-	var status int
+	status := 500
 	var code string
-	if len(args) > 1 {
+	if len(args) > 0 {
 		s, sOk := args[0].(int)
 		if sOk && s > 0 {
 			status = s
-		} else {
-			status = 500
 		}
 	}
-	if len(args) > 2 {
+	if len(args) > 1 {
 		c, cOk := args[1].(string)
 		if cOk && c != "" {
 			code = c
@@ -168,11 +188,32 @@ func NewRouter(args ...interface{}) *Router {
 		}
 		timeout = t
 	}
+	var idempotency IdempotencyStore
+	if options["idempotencyStore"] != nil {
+		store, ok := options["idempotencyStore"].(IdempotencyStore)
+		if !ok {
+			panic("Idempotency store should implement IdempotencyStore")
+		}
+		idempotency = store
+	}
+	var idempotencyScope IdempotencyScope
+	switch s := options["idempotencyScope"].(type) {
+	case nil:
+	case IdempotencyScope:
+		idempotencyScope = s
+	case func(map[string]interface{}) string:
+		idempotencyScope = s
+	default:
+		panic("Idempotency scope should be a function of the request context")
+	}
 	router := &Router{
-		Options:       options,
-		Introspection: introspection,
-		Timeout:       timeout,
-		Routes:        make(map[string]Route),
+		Options:          options,
+		Introspection:    introspection,
+		Timeout:          timeout,
+		Routes:           make(map[string]Route),
+		limits:           parseRequestLimits(options),
+		idempotency:      idempotency,
+		idempotencyScope: idempotencyScope,
 	}
 	return router
 }
@@ -281,6 +322,18 @@ func (r *Router) Describe(route string, config map[string]interface{}) error {
 		}
 		routeInfo.Timeout = int(timeout)
 	}
+
+	if cacheable, ok := config["cacheable"].(bool); ok {
+		routeInfo.Cacheable = cacheable
+	}
+
+	if config["maxAge"] != nil {
+		maxAge, ok := intValue(config["maxAge"])
+		if !ok || maxAge < 0 {
+			return errors.New("maxAge should be a positive integer")
+		}
+		routeInfo.MaxAge = maxAge
+	}
 	r.Routes[route] = routeInfo
 	return nil
 }
@@ -315,12 +368,15 @@ func (r *Router) Merge(router *Router) error {
 				timeout = r.Timeout
 			}
 			r.Routes[route] = Route{
-				Handler:     append(append(append([]interface{}{}, r.Middleware...), router.Routes[route].Handler...), r.Afterware...),
-				Description: router.Routes[route].Description,
-				Schema:      router.Routes[route].Schema,
-				Visible:     router.Routes[route].Visible,
-				Validate:    router.Routes[route].Validate,
-				Timeout:     timeout,
+				Handler:      append(append(append([]interface{}{}, r.Middleware...), router.Routes[route].Handler...), r.Afterware...),
+				Description:  router.Routes[route].Description,
+				Schema:       router.Routes[route].Schema,
+				Visible:      router.Routes[route].Visible,
+				Validate:     router.Routes[route].Validate,
+				Timeout:      timeout,
+				Subscription: router.Routes[route].Subscription,
+				Cacheable:    router.Routes[route].Cacheable,
+				MaxAge:       router.Routes[route].MaxAge,
 			}
 		}
 	}
@@ -373,12 +429,15 @@ func (r *Router) Namespace(prefix string, router *Router) error {
 				timeout = r.Timeout
 			}
 			r.Routes[nsRoute] = Route{
-				Handler:     append(append(append([]interface{}{}, r.Middleware...), router.Routes[route].Handler...), r.Afterware...),
-				Description: router.Routes[route].Description,
-				Schema:      router.Routes[route].Schema,
-				Visible:     router.Routes[route].Visible,
-				Validate:    router.Routes[route].Validate,
-				Timeout:     timeout,
+				Handler:      append(append(append([]interface{}{}, r.Middleware...), router.Routes[route].Handler...), r.Afterware...),
+				Description:  router.Routes[route].Description,
+				Schema:       router.Routes[route].Schema,
+				Visible:      router.Routes[route].Visible,
+				Validate:     router.Routes[route].Validate,
+				Timeout:      timeout,
+				Subscription: router.Routes[route].Subscription,
+				Cacheable:    router.Routes[route].Cacheable,
+				MaxAge:       router.Routes[route].MaxAge,
 			}
 		}
 	}
@@ -387,7 +446,10 @@ func (r *Router) Namespace(prefix string, router *Router) error {
 }
 
 func (r *Router) Handle(requests [][]interface{}, context map[string]interface{}) ([][4]interface{}, map[string]interface{}) {
-	return handleRequest(r.Routes, requests, context)
+	if limitErr := r.limits.check(requests); limitErr != nil {
+		return handleError(limitErr.StatusCode, limitErr.Code, limitErr.Message)
+	}
+	return handleRequest(r.Routes, requests, withIdempotencyStore(context, r.idempotency, r.idempotencyScope))
 }
 
 func Default(options map[string]interface{}) *Router {
@@ -395,10 +457,28 @@ func Default(options map[string]interface{}) *Router {
 }
 
 func (r *Router) Run() {
-	server := NewHttpServer(r.Handle, r.Options)
+	server := NewHttpServer(r.Handle, r.httpOptions())
 	log.Fatal(server.ListenAndServe())
 }
 
+func (r *Router) HttpHandler() http.Handler {
+	return NewHttpHandler(r.Handle, r.httpOptions())
+}
+
+func (r *Router) httpOptions() map[string]interface{} {
+	options := make(map[string]interface{}, len(r.Options)+2)
+	for key, value := range r.Options {
+		options[key] = value
+	}
+	if options["streamHandler"] == nil {
+		options["streamHandler"] = StreamHandler(r.HandleStream)
+	}
+	if options["cachePolicy"] == nil {
+		options["cachePolicy"] = CachePolicy(r.cachePolicy)
+	}
+	return options
+}
+
 func constructHttpHeaders(options map[string]interface{}) map[string]string {
 	httpHeaders := map[string]string{
 		"access-control-allow-origin":       "",
@@ -475,14 +555,12 @@ func constructHttpHeaders(options map[string]interface{}) map[string]string {
 }
 
 func NewHttpServer(requestHandler RequestHandler, args ...interface{}) *http.Server {
-
 	var options map[string]interface{}
-
-	opts, ok := args[0].(map[string]interface{})
-	if ok {
-		options = opts
-	} else {
-		fmt.Println("Value is not of type Person")
+	if len(args) > 0 {
+		o, oOk := args[0].(map[string]interface{})
+		if oOk {
+			options = o
+		}
 	}
 
 	port, portOk := options["port"].(int)
@@ -490,25 +568,67 @@ func NewHttpServer(requestHandler RequestHandler, args ...interface{}) *http.Ser
 		port = 8080
 	}
 
+	mux := http.NewServeMux()
+	mux.Handle("/", NewHttpHandler(requestHandler, options))
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s%d", ":", port),
+		Handler: mux,
+	}
+
+	return server
+}
+
+func NewHttpHandler(requestHandler RequestHandler, args ...interface{}) http.Handler {
+	var options map[string]interface{}
+	if len(args) > 0 {
+		o, oOk := args[0].(map[string]interface{})
+		if oOk {
+			options = o
+		}
+	}
+
 	url, urlOk := options["url"].(string)
 	if !urlOk || url == "" {
 		url = "/"
 	}
 
 	httpHeaders := constructHttpHeaders(options)
+	limits := parseRequestLimits(options)
+	compression := parseCompressionConfig(options)
+	codecs := parseCodecs(options)
+	encryption := parseEncryptionConfig(options)
+	signing := parseSigningConfig(options)
 
-	server := &http.Server{
-		Addr: fmt.Sprintf("%s%d", ":", port),
+	var streamHandler StreamHandler
+	switch h := options["streamHandler"].(type) {
+	case StreamHandler:
+		streamHandler = h
+	case func([][]interface{}, map[string]interface{}, func([4]interface{})) map[string]interface{}:
+		streamHandler = h
+	}
+	if streamHandler == nil {
+		streamHandler = bufferedStreamHandler(requestHandler)
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
+	var cachePolicy CachePolicy
+	switch p := options["cachePolicy"].(type) {
+	case CachePolicy:
+		cachePolicy = p
+	case func(string) (bool, int):
+		cachePolicy = p
+	}
 
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+	websocketEnabled, _ := options["websocket"].(bool)
+	if websocketEnabled && signing != nil {
+		panic("WebSocket connections cannot be used when signed requests are required")
+	}
+	checkOrigin := websocketOriginChecker(httpHeaders["access-control-allow-origin"])
+	capabilities := httpCapabilities(codecs, compression, encryption, signing, limits, cachePolicy != nil, websocketEnabled)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != url {
+			writeHttpError(w, http.StatusNotFound, "NOT_FOUND", "Not Found")
 			return
 		}
 
@@ -525,102 +645,569 @@ func NewHttpServer(requestHandler RequestHandler, args ...interface{}) *http.Ser
 		w.Header().Set("x-frame-options", httpHeaders["x-frame-options"])
 		w.Header().Set("x-permitted-cross-domain-policies", httpHeaders["x-permitted-cross-domain-policies"])
 		w.Header().Set("x-xss-protection", httpHeaders["x-xss-protection"])
+		w.Header().Set(versionHeader, strconv.Itoa(ProtocolVersion))
 
-		var data [][]interface{}
-		err := json.NewDecoder(r.Body).Decode(&data)
+		if versionErr := checkVersion(r.Header.Get(versionHeader)); versionErr != nil {
+			writeHttpError(w, versionErr.StatusCode, versionErr.Code, versionErr.Message)
+			return
+		}
+
+		// WebSocket frames are neither encrypted nor signed
+		if websocketEnabled && websocket.IsWebSocketUpgrade(r) {
+			if encryption != nil && encryption.required {
+				writeHttpError(w, http.StatusBadRequest, "ENCRYPTION_REQUIRED", "Requests should be encrypted")
+				return
+			}
+			serveWebSocket(w, r, streamHandler, findCodec(codecs, "application/json"), limits, checkOrigin)
+			return
+		}
+
+		isGet := r.Method == http.MethodGet && cachePolicy != nil
+		if r.Method != http.MethodPost && !isGet {
+			writeHttpError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method Not Allowed")
+			return
+		}
+
+		bodyReader, err := decompressBody(compression, r.Header.Get("Content-Encoding"), limits.limitBody(w, r.Body))
+		if err != nil {
+			blestErr := err.(*BlestError)
+			writeHttpError(w, blestErr.StatusCode, blestErr.Code, blestErr.Message)
+			return
+		}
+
+		body, err := io.ReadAll(limits.limitBody(w, bodyReader))
 		if err != nil {
-			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeHttpError(w, http.StatusRequestEntityTooLarge, "BODY_TOO_LARGE", fmt.Sprintf("Request body should be at most %d bytes", limits.maxBodySize))
+			} else {
+				writeHttpError(w, http.StatusBadRequest, "INVALID_BODY", "Failed to read request body")
+			}
+			return
+		}
+
+		var signingKeyId string
+		if signing != nil {
+			var signatureErr *BlestError
+			signingKeyId, signatureErr = signing.verify(r, body, time.Now())
+			if signatureErr != nil {
+				writeHttpError(w, signatureErr.StatusCode, signatureErr.Code, signatureErr.Message)
+				return
+			}
+		}
+
+		requestContentType := r.Header.Get("Content-Type")
+		if isGet {
+			body, err = decodeBatchQuery(r.URL.Query().Get(batchQueryParam))
+			if err != nil || len(body) == 0 {
+				writeHttpError(w, http.StatusBadRequest, "INVALID_QUERY", "Failed to parse batch query parameter")
+				return
+			} else if limits.maxBodySize > 0 && int64(len(body)) > limits.maxBodySize {
+				writeHttpError(w, http.StatusRequestEntityTooLarge, "BODY_TOO_LARGE", fmt.Sprintf("Request body should be at most %d bytes", limits.maxBodySize))
+				return
+			}
+			requestContentType = JSONCodec{}.ContentType()
+		}
+
+		var session *encryptionSession
+		if mediaType, _, _ := mime.ParseMediaType(requestContentType); mediaType == encryptedContentType {
+			if encryption == nil {
+				writeHttpError(w, http.StatusUnsupportedMediaType, "ENCRYPTION_UNSUPPORTED", "Encrypted requests are not supported")
+				return
+			}
+			var encryptionErr *BlestError
+			body, requestContentType, session, encryptionErr = encryption.open(body)
+			if encryptionErr != nil {
+				writeHttpError(w, encryptionErr.StatusCode, encryptionErr.Code, encryptionErr.Message)
+				return
+			}
+		} else if encryption != nil && encryption.required {
+			writeHttpError(w, http.StatusBadRequest, "ENCRYPTION_REQUIRED", "Requests should be encrypted")
 			return
 		}
 
+		var attachments map[string]*Attachment
+		if mediaType, params, _ := mime.ParseMediaType(requestContentType); mediaType == multipartFormType {
+			body, requestContentType, attachments, err = readMultipart(body, params["boundary"])
+			if err != nil {
+				writeHttpError(w, http.StatusBadRequest, "INVALID_MULTIPART", "Failed to parse multipart request body")
+				return
+			}
+		}
+
+		requestCodec := findCodec(codecs, requestContentType)
+		if requestCodec == nil {
+			requestCodec = findCodec(codecs, "application/json")
+		}
+
+		var data [][]interface{}
+		if err := requestCodec.Unmarshal(body, &data); err != nil {
+			if _, ok := requestCodec.(JSONCodec); ok {
+				writeHttpError(w, http.StatusBadRequest, "INVALID_JSON", "Failed to parse request body")
+			} else {
+				writeHttpError(w, http.StatusBadRequest, "INVALID_BODY", "Failed to parse request body")
+			}
+			return
+		}
+
+		if limitErr := limits.check(data); limitErr != nil {
+			writeHttpError(w, limitErr.StatusCode, limitErr.Code, limitErr.Message)
+			return
+		}
+
+		if attachments != nil {
+			for _, request := range data {
+				if len(request) < 3 {
+					continue
+				}
+				if request[2], err = resolveParts(request[2], attachments); err != nil {
+					writeHttpError(w, http.StatusBadRequest, "INVALID_PART", err.Error())
+					return
+				}
+			}
+		}
+
+		var maxAge int
+		if isGet {
+			var cacheErr *BlestError
+			maxAge, cacheErr = batchMaxAge(cachePolicy, data)
+			if cacheErr != nil {
+				writeHttpError(w, cacheErr.StatusCode, cacheErr.Code, cacheErr.Message)
+				return
+			}
+		}
+
 		context := map[string]interface{}{
-			"headers": r.Header,
+			"headers":              r.Header,
+			capabilitiesContextKey: capabilities,
+		}
+		if session != nil {
+			context["encryptionKeyId"] = session.keyID
+		}
+		if signingKeyId != "" {
+			context["signingKeyId"] = signingKeyId
+		}
+
+		// Encrypted responses are sealed as a whole, so they are never streamed
+		if streamType := acceptedStreamType(r); streamType != "" && session == nil && !isGet {
+			subscriptions := newSubscriptionSet()
+			context[subscriptionsContextKey] = subscriptions
+			requestDone := make(chan struct{})
+			go func() {
+				select {
+				case <-r.Context().Done():
+				case <-requestDone:
+				}
+				subscriptions.closeAll()
+			}()
+			sw := &streamWriter{w: w, contentType: streamType}
+			reqErr := streamHandler(data, context, sw.write)
+			close(requestDone)
+			if reqErr != nil && !sw.started {
+				writeRequestError(w, reqErr)
+			} else if reqErr != nil {
+				log.Println(reqErr["message"])
+			} else if !sw.started {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
 		}
 
 		result, reqErr := requestHandler(data, context)
-		// result, ok1 := response[0].([][4]interface{})
-		// reqErr, ok2 := response[1].(map[string]interface{})
 		if reqErr != nil {
-			log.Println(reqErr["message"])
-			statusCode, ok := reqErr["code"].(int)
-			if !ok {
-				statusCode = 500
-			}
-			w.WriteHeader(statusCode)
-			fmt.Fprint(w, reqErr["error"])
+			writeRequestError(w, reqErr)
 			return
-			// } else {
-			// 	log.Println(reqErr)
-			// 	w.WriteHeader(http.StatusInternalServerError)
-			// 	fmt.Fprint(w, "Request handler returned an improperly formatted response")
-			// 	return
 		} else if result != nil {
-			responseJSON, err := json.Marshal(result)
+			responseCodec := requestCodec
+			if session == nil {
+				responseCodec = negotiateCodec(codecs, r.Header.Get("Accept"), requestCodec)
+			}
+			responseContentType := responseCodec.ContentType()
+			var responseBody []byte
+			var err error
+			if session == nil && !isGet && acceptsMultipart(r.Header.Get("Accept")) && resultHasAttachments(result) {
+				responseBody, responseContentType, err = marshalMultipartResult(responseCodec, result)
+			} else {
+				responseBody, err = responseCodec.Marshal(result)
+			}
+			if err == nil && session != nil {
+				responseBody, err = session.seal(encryptionResponse, responseContentType, responseBody)
+				responseContentType = encryptedContentType
+			}
 			if err != nil {
 				log.Println(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprint(w, err.Error())
+				writeHttpError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", err.Error())
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprint(w, string(responseJSON))
+			if isGet {
+				etag := computeETag(responseBody)
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Cache-Control", cacheControl(result, maxAge, signing != nil || r.Header.Get("Authorization") != ""))
+				w.Header().Add("Vary", strings.Join(cacheVary(signing != nil), ", "))
+				if etagMatches(r.Header.Get("If-None-Match"), etag) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			writeHttpBody(w, r, compression, http.StatusOK, responseContentType, responseBody)
 			return
 		} else {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
 	})
+}
 
-	return server
+func writeHttpBody(w http.ResponseWriter, r *http.Request, compression compressionConfig, statusCode int, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	if compression.enabled {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if len(body) >= compression.threshold {
+			if encoder := compression.negotiate(r.Header.Get("Accept-Encoding")); encoder != nil {
+				compressed, err := compressBody(encoder, body)
+				if err != nil {
+					log.Println(err)
+				} else {
+					w.Header().Set("Content-Encoding", encoder.Encoding())
+					body = compressed
+				}
+			}
+		}
+	}
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+func writeRequestError(w http.ResponseWriter, reqErr map[string]interface{}) {
+	log.Println(reqErr["message"])
+	statusCode, ok := reqErr["statusCode"].(int)
+	if !ok || statusCode == 0 {
+		statusCode = 500
+	}
+	code, _ := reqErr["code"].(string)
+	message, _ := reqErr["message"].(string)
+	writeHttpError(w, statusCode, code, message)
+}
+
+func writeHttpError(w http.ResponseWriter, statusCode int, code string, message string) {
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+	errorObject := map[string]interface{}{
+		"message":    message,
+		"statusCode": statusCode,
+	}
+	if code != "" {
+		errorObject["code"] = code
+	}
+	responseJSON, _ := json.Marshal(errorObject)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(responseJSON)
+}
+
+// NewHttpTransport returns the transport HttpClient uses by default. The
+// same *http.Client, from the httpClient option or a new one, is used for
+// every batch so that connections are reused.
+func NewHttpTransport(url string, args ...interface{}) Transport {
+	var options map[string]interface{}
+	if len(args) > 0 {
+		o, oOk := args[0].(map[string]interface{})
+		if oOk {
+			options = o
+		}
+	}
+	client := &http.Client{}
+	if options["httpClient"] != nil {
+		c, ok := options["httpClient"].(*http.Client)
+		if !ok || c == nil {
+			panic("HTTP client should be an *http.Client")
+		}
+		client = c
+	}
+	stream, _ := options["stream"].(bool)
+	negotiating, _ := options["negotiate"].(bool)
+	useNumber, _ := options["useNumber"].(bool)
+	codec, codecOk := options["codec"].(Codec)
+	if !codecOk || codec == nil {
+		codec = JSONCodec{UseNumber: useNumber}
+	}
+	cacheableRoutes := make(map[string]bool)
+	if options["cacheableRoutes"] != nil {
+		routes, ok := options["cacheableRoutes"].([]string)
+		if !ok {
+			panic("Cacheable routes should be a slice of strings")
+		}
+		for _, route := range routes {
+			cacheableRoutes[route] = true
+		}
+	}
+	return &httpTransport{
+		url:             url,
+		client:          client,
+		compression:     parseCompressionConfig(options),
+		stream:          stream,
+		codec:           codec,
+		codecs:          parseCodecs(options),
+		encryption:      parseClientEncryption(options),
+		signer:          parseRequestSigner(options),
+		cacheableRoutes: cacheableRoutes,
+		cache:           newResponseCache(256),
+		negotiating:     negotiating,
+	}
+}
+
+type httpTransport struct {
+	url             string
+	client          *http.Client
+	compression     compressionConfig
+	stream          bool
+	codec           Codec
+	codecs          []Codec
+	encryption      *clientEncryption
+	signer          *requestSigner
+	cacheableRoutes map[string]bool
+	cache           *responseCache
+	negotiating     bool
+	negotiation     negotiation
+}
+
+// Send posts a batch and calls respond with each result tuple, as soon as it
+// arrives when the response is streamed.
+func (t *httpTransport) Send(requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	if t.negotiating {
+		if err := t.negotiate(); err != nil {
+			return err
+		}
+	}
+	accept := JSONCodec{}.ContentType()
+	if t.codec != nil {
+		accept = t.codec.ContentType()
+	}
+	if t.cacheable(requests) {
+		if sent, err := t.get(requests, headers, respond); sent {
+			return err
+		}
+	}
+	if t.stream && t.encryption == nil {
+		accept = ndjsonContentType
+	}
+	return t.post(context.Background(), requests, headers, accept, respond)
+}
+
+func (t *httpTransport) subscribe(ctx context.Context, requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	if t.negotiating {
+		if err := t.negotiate(); err != nil {
+			return err
+		}
+	}
+	return t.post(ctx, requests, headers, sseContentType, respond)
 }
 
-func httpPostRequest(url string, data interface{}, headers map[string]string) [][]interface{} {
-	jsonData, err := json.Marshal(data)
+func (t *httpTransport) post(ctx context.Context, requests [][]interface{}, headers map[string]string, accept string, respond func([]interface{})) error {
+	compression := t.compression
+	codec := t.codec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	// Attachments are sent as parts of a multipart body, after the batch
+	var parts []*Attachment
+	wire := requests
+	for i, request := range requests {
+		if len(request) > 2 && hasAttachments(request[2]) {
+			if len(parts) == 0 {
+				wire = append([][]interface{}{}, requests...)
+			}
+			wire[i] = append([]interface{}{}, request...)
+			wire[i][2] = extractParts(request[2], &parts)
+		}
+	}
+	requestBody, err := codec.Marshal(wire)
 	if err != nil {
-		fmt.Printf("Failed to marshal JSON data: %s", err)
-		return nil
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	requestContentType := codec.ContentType()
+	if len(parts) > 0 {
+		requestBody, requestContentType, err = writeMultipart(multipartFormType, requestContentType, requestBody, parts)
+		if err != nil {
+			return fmt.Errorf("failed to write multipart request body: %w", err)
+		}
+	}
+	if accept != ndjsonContentType && accept != sseContentType {
+		accept += ", " + multipartMixedType
+	}
+	var session *encryptionSession
+	if t.encryption != nil {
+		session, err = t.encryption.newSession()
+		if err == nil {
+			requestBody, err = session.seal(encryptionRequest, requestContentType, requestBody)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to encrypt request body: %w", err)
+		}
+		requestContentType = encryptedContentType
+		accept = encryptedContentType
+	}
+
+	signedBody := requestBody
+	var contentEncoding string
+	if compression.request != nil && len(requestBody) >= compression.threshold {
+		requestBody, err = compressBody(compression.request, requestBody)
+		if err != nil {
+			return fmt.Errorf("failed to compress request body: %w", err)
+		}
+		contentEncoding = compression.request.Encoding()
 	}
 
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, "POST", t.url, bytes.NewBuffer(requestBody))
 	if err != nil {
-		fmt.Printf("Failed to create request: %s", err)
-		return nil
+		return fmt.Errorf("failed to create request: %w", err)
 	}
 
-	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Content-Type", requestContentType)
+	request.Header.Set("Accept", accept)
+	request.Header.Set(versionHeader, strconv.Itoa(ProtocolVersion))
+	if contentEncoding != "" {
+		request.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if compression.enabled {
+		request.Header.Set("Accept-Encoding", compression.acceptEncoding())
+	}
 
 	if len(headers) > 0 {
 		for key, value := range headers {
 			request.Header.Set(key, value)
 		}
 	}
+	if t.signer != nil {
+		t.signer.sign(request, signedBody, time.Now())
+	}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+	response, err := t.httpClient().Do(request)
 	if err != nil {
-		fmt.Printf("POST request failed: %s", err)
-		return nil
+		return fmt.Errorf("POST request failed: %w", err)
 	}
 	defer response.Body.Close()
 
-	body, err := io.ReadAll(response.Body)
+	bodyReader, err := decompressBody(compression, response.Header.Get("Content-Encoding"), response.Body)
+	if err != nil {
+		return err
+	}
+
+	contentType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if response.StatusCode == http.StatusOK && (contentType == ndjsonContentType || contentType == sseContentType) {
+		return readStream(bodyReader, contentType, t.jsonCodec(), respond)
+	}
+
+	body, err := io.ReadAll(bodyReader)
 	if err != nil {
-		fmt.Printf("Failed to read response body: %s", err)
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return parseHttpError(response.StatusCode, body)
+	} else if response.StatusCode == http.StatusNoContent {
 		return nil
 	}
 
+	responseContentType := response.Header.Get("Content-Type")
+	if session != nil {
+		if contentType != encryptedContentType {
+			return errors.New("response was not encrypted")
+		}
+		envelope, err := parseEnvelope(body)
+		if err == nil {
+			body, err = session.open(encryptionResponse, envelope)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decrypt response body: %w", err)
+		}
+		responseContentType = envelope.ContentType
+	}
+
+	if mediaType, params, _ := mime.ParseMediaType(responseContentType); mediaType == multipartMixedType {
+		batch, batchContentType, attachments, err := readMultipart(body, params["boundary"])
+		if err != nil {
+			return fmt.Errorf("failed to read multipart response body: %w", err)
+		}
+		return t.decodeResults(batch, batchContentType, func(item []interface{}) {
+			if len(item) > 2 {
+				resolved, err := resolveParts(item[2], attachments)
+				if err != nil {
+					log.Println(err)
+				} else {
+					item[2] = resolved
+				}
+			}
+			respond(item)
+		})
+	}
+
+	return t.decodeResults(body, responseContentType, respond)
+}
+
+func (t *httpTransport) decodeResults(body []byte, contentType string, respond func([]interface{})) error {
+	responseCodec := findCodec(t.codecs, contentType)
+	if responseCodec == nil {
+		responseCodec = t.jsonCodec()
+	}
+
 	var result [][]interface{}
-	err = json.Unmarshal(body, &result)
+	err := responseCodec.Unmarshal(body, &result)
 	if err != nil {
-		fmt.Printf("Failed to unmarshal JSON: %s", err)
-		return nil
+		return fmt.Errorf("failed to unmarshal response body: %w", err)
 	}
 
-	return result
+	for _, item := range result {
+		respond(item)
+	}
+
+	return nil
+}
+
+func (t *httpTransport) httpClient() *http.Client {
+	if t.client == nil {
+		return http.DefaultClient
+	}
+	return t.client
+}
+
+func (t *httpTransport) jsonCodec() Codec {
+	if codec := findCodec(t.codecs, "application/json"); codec != nil {
+		return codec
+	}
+	return JSONCodec{}
+}
+
+func parseHttpError(statusCode int, body []byte) *BlestError {
+	var errorObject map[string]interface{}
+	if err := json.Unmarshal(body, &errorObject); err != nil || errorObject == nil {
+		message := strings.TrimSpace(string(body))
+		if message == "" {
+			message = http.StatusText(statusCode)
+		}
+		return &BlestError{Message: message, StatusCode: statusCode}
+	}
+	return blestErrorFromMap(errorObject, statusCode)
+}
+
+func blestErrorFromMap(errorObject map[string]interface{}, defaultStatusCode int) *BlestError {
+	blestErr := &BlestError{StatusCode: defaultStatusCode}
+	blestErr.Message, _ = errorObject["message"].(string)
+	blestErr.Code, _ = errorObject["code"].(string)
+	if statusCode, ok := intValue(errorObject["statusCode"]); ok {
+		blestErr.StatusCode = statusCode
+	}
+	if blestErr.Message == "" {
+		blestErr.Message = http.StatusText(blestErr.StatusCode)
+	}
+	return blestErr
 }
 
 func (e *eventEmitter) on(event string, ch chan interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	if e.events == nil {
 		e.events = make(map[string][]chan interface{})
 	}
@@ -641,8 +1228,10 @@ func (e *eventEmitter) once(event string, ch chan interface{}) {
 }
 
 func (e *eventEmitter) emit(event string, args ...interface{}) {
-	channels := e.events[event]
-	if channels == nil {
+	e.mu.Lock()
+	channels := append([]chan interface{}{}, e.events[event]...)
+	e.mu.Unlock()
+	if len(channels) == 0 {
 		return
 	}
 	for _, ch := range channels {
@@ -653,10 +1242,15 @@ func (e *eventEmitter) emit(event string, args ...interface{}) {
 }
 
 func (e *eventEmitter) off(event string, ch chan interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	if channels := e.events[event]; channels != nil {
 		for i, c := range channels {
 			if c == ch {
 				e.events[event] = append(channels[:i], channels[i+1:]...)
+				if len(e.events[event]) == 0 {
+					delete(e.events, event)
+				}
 				break
 			}
 		}
@@ -676,38 +1270,102 @@ func NewHttpClient(url string, args ...interface{}) *HttpClient {
 			}
 		}
 	}
+	transport, transportOk := options["transport"].(Transport)
+	if !transportOk || transport == nil {
+		if urls, ok := options["urls"].([]string); ok {
+			transport = NewBalancedTransport(urls, options)
+		} else {
+			transport = NewHttpTransport(url, options)
+		}
+	}
+	policy := parseRetryPolicy(options)
+	if policy != nil {
+		transport = &retryTransport{transport: transport, policy: policy}
+	}
 	maxBatchSize := 100
 	queue := [][]interface{}{}
 	timeout := new(time.Timer)
 	emitter := &eventEmitter{}
 	timeout = nil
 	client := &HttpClient{
-		Url:          url,
-		Options:      options,
-		HttpHeaders:  httpHeaders,
-		MaxBatchSize: maxBatchSize,
-		Queue:        queue,
-		Timeout:      timeout,
-		Emitter:      emitter,
+		Url:            url,
+		Options:        options,
+		HttpHeaders:    httpHeaders,
+		MaxBatchSize:   maxBatchSize,
+		Queue:          queue,
+		Timeout:        timeout,
+		Emitter:        emitter,
+		transport:      transport,
+		requestTimeout: parseRequestTimeout(options, policy),
+		calls:          parseCallGroup(options),
+		offline:        parseOfflineQueue(options),
+	}
+	if client.offline != nil {
+		// Deliver whatever an earlier client left in the queue
+		client.offline.schedule(0, client.flushInBackground)
 	}
 	return client
 }
 
 func (c *HttpClient) Process() {
+	c.mu.Lock()
 	newQueue := c.Queue[:min(len(c.Queue), c.MaxBatchSize)]
 	c.Queue = c.Queue[len(newQueue):]
-	c.Timeout.Stop()
+	if c.Timeout != nil {
+		c.Timeout.Stop()
+	}
 	if len(c.Queue) == 0 {
 		c.Timeout = nil
 	} else {
-		c.Timeout.Reset(1 * time.Millisecond)
+		c.Timeout = time.AfterFunc(1*time.Millisecond, c.Process)
 	}
-	data := httpPostRequest(c.Url, newQueue, c.HttpHeaders)
-	for _, r := range data {
-		c.Emitter.emit(r[0].(string), r[2], r[3])
+	newQueue, notifications := c.takeNotifications(newQueue)
+	c.mu.Unlock()
+	if len(newQueue) == 0 {
+		return
+	}
+	answered := make(map[string]bool, len(newQueue))
+	err := c.send(newQueue, func(r []interface{}) {
+		id := r[0].(string)
+		answered[id] = true
+		c.Emitter.emit(id, r[2], r[3])
+	})
+	for _, ch := range notifications {
+		ch <- err
+	}
+	if err != nil {
+		for _, r := range newQueue {
+			if id := r[0].(string); id != "" && !answered[id] {
+				c.Emitter.emit(id, err)
+			}
+		}
 	}
 }
 
+// send passes a batch through the batch interceptors to the transport, with
+// its own copy of the client's HTTP headers. Malformed responses are dropped.
+func (c *HttpClient) send(requests [][]interface{}, respond func([]interface{})) error {
+	c.mu.Lock()
+	interceptors := c.batchInterceptors
+	headers := make(map[string]string, len(c.HttpHeaders))
+	for key, value := range c.HttpHeaders {
+		headers[key] = value
+	}
+	c.mu.Unlock()
+	send := chainBatchInterceptors(interceptors, func(requests [][]interface{}, headers map[string]string) error {
+		return c.transport.Send(requests, headers, func(r []interface{}) {
+			if len(r) < 4 {
+				return
+			}
+			if _, ok := r[0].(string); !ok {
+				return
+			}
+			respond(r)
+		})
+	})
+	return send(requests, headers)
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -716,90 +1374,193 @@ func min(a, b int) int {
 }
 
 func (c *HttpClient) Request(route string, args ...interface{}) (map[string]interface{}, error) {
-	if route == "" {
+	body, headers, err := parseRequestArgs(route, args)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	interceptors := c.requestInterceptors
+	c.mu.Unlock()
+	next := c.enqueue
+	if c.calls != nil {
+		next = func(call *Call) (map[string]interface{}, error) {
+			return c.calls.do(call, c.enqueue)
+		}
+	}
+	return chainRequestInterceptors(interceptors, next)(&Call{Route: route, Body: body, Headers: headers})
+}
+
+func (c *HttpClient) enqueue(call *Call) (map[string]interface{}, error) {
+	if call.Route == "" {
 		return nil, errors.New("route is required")
 	}
+	id := uuid.New().String()
+	ch := make(chan interface{}, 1)
+	c.Emitter.once(id, ch)
+	c.mu.Lock()
+	c.Queue = append(c.Queue, []interface{}{id, call.Route, call.Body, call.Headers})
+	if c.Timeout == nil {
+		c.Timeout = time.AfterFunc(1*time.Millisecond, c.Process)
+	}
+	c.mu.Unlock()
+	return awaitResponse(ch, c.requestTimeout)
+}
+
+func parseRequestArgs(route string, args []interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	if route == "" {
+		return nil, nil, errors.New("route is required")
+	}
 
 	var body map[string]interface{}
-	if len(args) > 0 {
+	if len(args) > 0 && args[0] != nil {
 		b, ok := args[0].(map[string]interface{})
-		if !ok && b != nil {
-			return nil, errors.New("body should be a map")
+		if !ok {
+			return nil, nil, errors.New("body should be a map")
 		}
 		body = b
 	}
 
 	var headers map[string]interface{}
-	if len(args) > 0 {
+	if len(args) > 1 && args[1] != nil {
 		h, ok := args[1].(map[string]interface{})
-		if !ok && h != nil {
-			return nil, errors.New("headers should be a map")
+		if !ok {
+			return nil, nil, errors.New("headers should be a map")
 		}
 		headers = h
 	}
 
-	id := uuid.New().String()
-	ch := make(chan interface{}, 1)
-	c.Emitter.once(id, ch)
-	c.Queue = append(c.Queue, []interface{}{id, route, body, headers})
-	if c.Timeout == nil {
-		c.Timeout = time.AfterFunc(1*time.Millisecond, c.Process)
+	return body, headers, nil
+}
+
+// itemResult converts the result and error of a response item into what
+// Request returns.
+func itemResult(resultValue interface{}, errorValue interface{}) (map[string]interface{}, error) {
+	errVal, ok := errorValue.(map[string]interface{})
+	if !ok && errorValue != nil {
+		return nil, errors.New("invalid error format")
+	}
+	if errVal != nil {
+		return nil, blestErrorFromMap(errVal, 500)
+	}
+
+	result, ok := resultValue.(map[string]interface{})
+	if !ok && result != nil {
+		return nil, errors.New("invalid result format")
+	}
+
+	return result, nil
+}
+
+// defaultRequestTimeout bounds how long a call waits for its result, on top
+// of any time the client spends waiting between retries.
+const defaultRequestTimeout = 5 * time.Second
+
+// parseRequestTimeout reads how long a call waits for its result. A call
+// waits through every retry of its batch, so the default grows with the
+// retry delays and a timeout that they alone could use up is rejected.
+func parseRequestTimeout(options map[string]interface{}, policy *retryPolicy) time.Duration {
+	var budget time.Duration
+	if policy != nil {
+		budget = policy.budget()
+	}
+	if options["requestTimeout"] == nil {
+		return defaultRequestTimeout + budget
+	}
+	t, ok := options["requestTimeout"].(int)
+	if !ok || t <= 0 {
+		panic("Request timeout should be a positive integer")
+	}
+	timeout := time.Duration(t) * time.Millisecond
+	if timeout <= budget {
+		panic(fmt.Sprintf("Request timeout should be longer than the %d milliseconds spent waiting between retries", budget.Milliseconds()))
 	}
+	return timeout
+}
+
+// awaitResponse waits for the result or error emitted for a single request.
+func awaitResponse(ch chan interface{}, timeout time.Duration) (map[string]interface{}, error) {
 	select {
 	case val := <-ch:
-		if err, ok := val.(error); ok {
-			return nil, err
-		}
-
 		myVal, ok := val.([]interface{})
+		if ok && len(myVal) == 1 {
+			if err, ok := myVal[0].(error); ok {
+				return nil, err
+			}
+		}
 		if !ok || len(myVal) != 2 {
 			return nil, errors.New("invalid response format")
 		}
-
-		errVal, ok := myVal[1].(map[string]interface{})
-		if !ok && errVal != nil {
-			return nil, errors.New("invalid error format")
-		}
-		if errVal != nil {
-			errMsg, _ := errVal["message"].(string)
-			return nil, errors.New(errMsg)
-		}
-
-		result, ok := myVal[0].(map[string]interface{})
-		if !ok && result != nil {
-			return nil, errors.New("invalid result format")
-		}
-
-		return result, nil
-	case <-time.After(5 * time.Second):
+		return itemResult(myVal[0], myVal[1])
+	case <-time.After(timeout):
 		return nil, errors.New("Request timed out")
 	}
 }
 
 func handleRequest(routes map[string]Route, requests [][]interface{}, context map[string]interface{}) ([][4]interface{}, map[string]interface{}) {
+	results := make([][4]interface{}, len(requests))
+	reqErr := handleRequestStream(routes, requests, context, false, func(index int, result [4]interface{}) {
+		results[index] = result
+	})
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	// Notifications leave their slots empty
+	emitted := make([][4]interface{}, 0, len(results))
+	for _, result := range results {
+		if result[0] != nil {
+			emitted = append(emitted, result)
+		}
+	}
+	return handleResult(emitted)
+}
+
+type preparedRequest struct {
+	request      requestObject
+	handler      []interface{}
+	context      map[string]interface{}
+	timeout      int
+	subscription SubscriptionHandler
+	notification bool
+}
+
+// handleRequestStream validates the whole batch before running any of it,
+// then runs its items one after another in order, or all at once when
+// concurrent is set, and emits each result as soon as it is ready, along
+// with the index of the item that produced it. Items with an empty ID are
+// notifications, which run without emitting a result and are not waited
+// for. Items that refer to the results of earlier items wait for them, see
+// newDependencyGraph, and the items of such batches always run at once so
+// that independent ones are not held up.
+func handleRequestStream(routes map[string]Route, requests [][]interface{}, context map[string]interface{}, concurrent bool, emit func(int, [4]interface{})) map[string]interface{} {
 	if routes == nil {
 		panic("Routes are required")
 	} else if len(requests) == 0 {
-		return handleError(400, "Request body should be a JSON array")
+		_, reqErr := handleError(400, "INVALID_BATCH", "Request body should be a JSON array")
+		return reqErr
 	}
 
 	batchId := uuid.New().String()
 	uniqueIds := make(map[string]bool)
-	var results [][4]interface{}
+	prepared := make([]preparedRequest, 0, len(requests))
 
 	for _, request := range requests {
-		if !isSlice(request) {
-			return handleError(400, "Request item should be an array")
+		if !isSlice(request) || len(request) < 2 {
+			_, reqErr := handleError(400, "INVALID_BATCH", "Request item should be an array with an ID and a route")
+			return reqErr
 		}
 
 		id, ok := request[0].(string)
-		if !ok || id == "" {
-			return handleError(400, "Request item should have an ID")
+		if !ok {
+			_, reqErr := handleError(400, "MISSING_ID", "Request item should have an ID")
+			return reqErr
 		}
+		notification := id == ""
 
 		route, ok := request[1].(string)
 		if !ok || route == "" {
-			return handleError(400, "Request item should have a route")
+			_, reqErr := handleError(400, "MISSING_ROUTE", "Request item should have a route")
+			return reqErr
 		}
 
 		var body map[string]interface{}
@@ -818,19 +1579,28 @@ func handleRequest(routes map[string]Route, requests [][]interface{}, context ma
 			}
 		}
 
-		if _, exists := uniqueIds[id]; exists {
-			return handleError(400, "Request items should have unique IDs")
+		if _, exists := uniqueIds[id]; exists && !notification {
+			_, reqErr := handleError(400, "DUPLICATE_ID", "Request items should have unique IDs")
+			return reqErr
 		}
 		uniqueIds[id] = true
 
 		var timeout int
 		var routeHandler []interface{}
+		var subscription SubscriptionHandler
 		thisRoute, exists := routes[route]
 		if exists {
 			routeHandler = thisRoute.Handler
+			if !notification {
+				subscription = thisRoute.Subscription
+			}
 			if thisRoute.Timeout > 0 {
 				timeout = thisRoute.Timeout
 			}
+		} else if route == "_unsubscribe" {
+			routeHandler = []interface{}{unsubscribe}
+		} else if route == "_capabilities" {
+			routeHandler = []interface{}{describeCapabilities}
 		} else {
 			routeHandler = []interface{}{routeNotFound}
 		}
@@ -851,25 +1621,78 @@ func handleRequest(routes map[string]Route, requests [][]interface{}, context ma
 		requestContext["route"] = route
 		requestContext["headers"] = headers
 
-		resultChan := routeReducer(routeHandler, requestObject, requestContext, timeout)
-		// if err != nil {
-		// 	return handleError(500, err.Error())
-		// }
+		prepared = append(prepared, preparedRequest{
+			request:      requestObject,
+			handler:      routeHandler,
+			context:      requestContext,
+			timeout:      timeout,
+			subscription: subscription,
+			notification: notification,
+		})
+	}
+
+	graph, reqErr := newDependencyGraph(prepared)
+	if reqErr != nil {
+		return reqErr
+	}
 
-		for result := range resultChan {
-			results = append(results, result)
+	idempotency, _ := context[idempotencyContextKey].(IdempotencyStore)
+	run := func(index int, p preparedRequest, emit func([4]interface{})) {
+		if graph != nil {
+			var ready bool
+			if p, ready = graph.await(index, p, emit); !ready {
+				return
+			}
+			emit = graph.record(index, emit)
 		}
+		runPrepared(p, idempotency, emit)
+	}
+
+	var wg sync.WaitGroup
+	for i, p := range prepared {
+		if p.notification {
+			go run(i, p, func([4]interface{}) {})
+			continue
+		} else if !concurrent && graph == nil {
+			index := i
+			run(i, p, func(result [4]interface{}) {
+				emit(index, result)
+			})
+			continue
+		}
+		wg.Add(1)
+		go func(index int, p preparedRequest) {
+			defer wg.Done()
+			run(index, p, func(result [4]interface{}) {
+				emit(index, result)
+			})
+		}(i, p)
 	}
+	wg.Wait()
 
-	return handleResult(results)
+	return nil
+}
+
+func runPrepared(p preparedRequest, idempotency IdempotencyStore, emit func([4]interface{})) {
+	if p.subscription != nil {
+		runSubscription(p, p.subscription, emit)
+		return
+	}
+	if key := idempotencyKey(p.request.Headers); key != "" && idempotency != nil {
+		runIdempotent(idempotency, key, p, emit)
+		return
+	}
+	for result := range routeReducer(p.handler, p.request, p.context, p.timeout) {
+		emit(result)
+	}
 }
 
 func handleResult(result [][4]interface{}) ([][4]interface{}, map[string]interface{}) {
 	return result, nil
 }
 
-func handleError(code int, message string) ([][4]interface{}, map[string]interface{}) {
-	return nil, map[string]interface{}{"code": code, "message": message}
+func handleError(statusCode int, code string, message string) ([][4]interface{}, map[string]interface{}) {
+	return nil, map[string]interface{}{"statusCode": statusCode, "code": code, "message": message}
 }
 
 func routeNotFound() (map[string]interface{}, error) {
@@ -877,20 +1700,25 @@ func routeNotFound() (map[string]interface{}, error) {
 }
 
 func routeReducer(handler []interface{}, request requestObject, context map[string]interface{}, timeout int) <-chan [4]interface{} {
-	resultChan := make(chan [4]interface{})
+	resultChan := make(chan [4]interface{}, 1)
+	var sendOnce sync.Once
+	send := func(result [4]interface{}) {
+		sendOnce.Do(func() {
+			resultChan <- result
+			close(resultChan)
+		})
+	}
 
 	go func() {
-		defer close(resultChan)
-
 		var timer *time.Timer
-		var timedOut bool
+		var timedOut atomic.Bool
 		id, route, body, headers := request.ID, request.Route, request.Body, request.Headers.(map[string]interface{})
 
 		if timeout > 0 {
 			timer = time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
-				timedOut = true
-				fmt.Printf("The route \"%s\" timed out after %d milliseconds\n", route, timeout)
-				resultChan <- [4]interface{}{id, route, nil, map[string]interface{}{"message": "Internal Server Error", "statusCode": 500}}
+				timedOut.Store(true)
+				log.Printf("The route \"%s\" timed out after %d milliseconds", route, timeout)
+				send([4]interface{}{id, route, nil, map[string]interface{}{"message": "Internal Server Error", "statusCode": 500}})
 			})
 		}
 
@@ -900,7 +1728,7 @@ func routeReducer(handler []interface{}, request requestObject, context map[stri
 
 		for _, f := range handler {
 			argCount := reflect.ValueOf(f).Type().NumIn()
-			if (timedOut || err != nil) && argCount <= 2 {
+			if (timedOut.Load() || err != nil) && argCount <= 2 {
 				continue
 			}
 			if err == nil && argCount > 2 {
@@ -965,7 +1793,7 @@ func routeReducer(handler []interface{}, request requestObject, context map[stri
 			}
 		}
 
-		if timedOut {
+		if timedOut.Load() {
 			return
 		}
 
@@ -974,13 +1802,14 @@ func routeReducer(handler []interface{}, request requestObject, context map[stri
 		}
 
 		if err != nil {
-			var statusCode int
+			errorObject := map[string]interface{}{"message": err.Error(), "statusCode": 500}
 			if blestErr, ok := err.(*BlestError); ok {
-				statusCode = blestErr.StatusCode
-			} else {
-				statusCode = 500
+				errorObject["statusCode"] = blestErr.StatusCode
+				if blestErr.Code != "" {
+					errorObject["code"] = blestErr.Code
+				}
 			}
-			resultChan <- [4]interface{}{id, route, nil, map[string]interface{}{"message": err.Error(), "statusCode": statusCode}}
+			send([4]interface{}{id, route, nil, errorObject})
 		} else if result != nil {
 			switch result.(type) { // r :=
 			case map[string]interface{}:
@@ -989,11 +1818,12 @@ func routeReducer(handler []interface{}, request requestObject, context map[stri
 					result = filterObject(result.(map[string]interface{}), selector)
 				}
 			default:
-				resultChan <- [4]interface{}{id, route, nil, map[string]interface{}{"message": "The result, if any, should be a JSON object", "statusCode": 500}}
+				send([4]interface{}{id, route, nil, map[string]interface{}{"message": "The result, if any, should be a JSON object", "statusCode": 500}})
+				return
 			}
-			resultChan <- [4]interface{}{id, route, result, nil}
+			send([4]interface{}{id, route, result, nil})
 		} else {
-			resultChan <- [4]interface{}{id, route, nil, nil}
+			send([4]interface{}{id, route, nil, nil})
 		}
 	}()
 
@@ -1,10 +1,14 @@
 package blest
 
 import (
+	"encoding/json"
 	"errors"
 	"math"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -216,3 +220,62 @@ func TestRouter(t *testing.T) {
 		router.Route("abc/abc-/abc", dummyController)
 	})
 }
+
+func TestHttpErrors(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter()
+	router.Route("basicRoute", func(body map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"hello": "world"}, nil
+	})
+	router.Route("errorRoute", func(body map[string]interface{}) (interface{}, error) {
+		return nil, NewBlestError("Forbidden", 403, "FORBIDDEN")
+	})
+
+	server := httptest.NewServer(NewHttpHandler(router.Handle))
+	defer server.Close()
+
+	// Malformed JSON
+	response, err := http.Post(server.URL, "application/json", strings.NewReader("[[\"abc\""))
+	assert.Nil(t, err)
+	var errorObject map[string]interface{}
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&errorObject))
+	response.Body.Close()
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	assert.Equal(t, "INVALID_JSON", errorObject["code"])
+	assert.Equal(t, float64(400), errorObject["statusCode"])
+	assert.Equal(t, "Failed to parse request body", errorObject["message"])
+
+	// Duplicate IDs
+	response, err = http.Post(server.URL, "application/json", strings.NewReader(`[["abc","basicRoute"],["abc","basicRoute"]]`))
+	assert.Nil(t, err)
+	errorObject = nil
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&errorObject))
+	response.Body.Close()
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Equal(t, "DUPLICATE_ID", errorObject["code"])
+	assert.Equal(t, "Request items should have unique IDs", errorObject["message"])
+
+	// Batch errors parsed by the client
+	transport := &httpTransport{url: server.URL}
+	reqErr := transport.Send([][]interface{}{{"abc", "basicRoute"}, {"abc", "basicRoute"}}, nil, func(result []interface{}) {})
+	blestErr, ok := reqErr.(*BlestError)
+	assert.True(t, ok)
+	assert.Equal(t, 400, blestErr.StatusCode)
+	assert.Equal(t, "DUPLICATE_ID", blestErr.Code)
+	assert.Equal(t, "Request items should have unique IDs", blestErr.Message)
+
+	// Item errors returned to the client
+	client := NewHttpClient(server.URL)
+	result, reqErr := client.Request("basicRoute", nil)
+	assert.Nil(t, reqErr)
+	assert.Equal(t, "world", result["hello"])
+
+	_, reqErr = client.Request("errorRoute", map[string]interface{}{})
+	blestErr, ok = reqErr.(*BlestError)
+	assert.True(t, ok)
+	assert.Equal(t, 403, blestErr.StatusCode)
+	assert.Equal(t, "FORBIDDEN", blestErr.Code)
+	assert.Equal(t, "Forbidden", blestErr.Message)
+}
@@ -0,0 +1,253 @@
+package blest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachePolicy reports whether a route may be requested with GET, and for how
+// many seconds its results may be cached.
+type CachePolicy func(route string) (cacheable bool, maxAge int)
+
+// batchQueryParam holds a GET batch as unpadded base64url-encoded JSON.
+const batchQueryParam = "b"
+
+// maxGetUrlLength keeps GET requests within the URL limits of common proxies
+// and CDNs. Longer batches are sent with POST.
+const maxGetUrlLength = 2048
+
+func (r *Router) cachePolicy(route string) (bool, int) {
+	routeInfo, exists := r.Routes[route]
+	if !exists || !routeInfo.Cacheable || routeInfo.Subscription != nil {
+		return false, 0
+	}
+	return true, routeInfo.MaxAge
+}
+
+func encodeBatchQuery(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeBatchQuery(query string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(query)
+}
+
+// batchMaxAge checks that every item of a GET batch is well formed and
+// cacheable, and returns the shortest max age among them.
+func batchMaxAge(policy CachePolicy, data [][]interface{}) (int, *BlestError) {
+	for _, request := range data {
+		if len(request) < 2 {
+			return 0, &BlestError{Message: "Request item should be an array with an ID and a route", StatusCode: 400, Code: "INVALID_BATCH"}
+		} else if _, ok := request[1].(string); !ok {
+			return 0, &BlestError{Message: "Request item should have a route", StatusCode: 400, Code: "INVALID_BATCH"}
+		}
+	}
+	maxAge := -1
+	for _, request := range data {
+		route := request[1].(string)
+		cacheable, routeMaxAge := policy(route)
+		if !cacheable {
+			return 0, &BlestError{Message: fmt.Sprintf("Route is not cacheable: %s", route), StatusCode: 405, Code: "METHOD_NOT_ALLOWED"}
+		}
+		if maxAge < 0 || routeMaxAge < maxAge {
+			maxAge = routeMaxAge
+		}
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return maxAge, nil
+}
+
+// cacheControl is no-store when any item failed, so that errors are never
+// cached, and otherwise lets caches keep the results for maxAge seconds.
+// Results of authenticated requests are only kept by the client's own cache.
+func cacheControl(result [][4]interface{}, maxAge int, private bool) string {
+	for _, item := range result {
+		if item[3] != nil {
+			return "no-store"
+		}
+	}
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	if private {
+		return "private, max-age=" + strconv.Itoa(maxAge)
+	}
+	return "public, max-age=" + strconv.Itoa(maxAge)
+}
+
+// cacheVary lists the request headers a GET response depends on, including
+// the credentials that make it private.
+func cacheVary(signed bool) []string {
+	vary := []string{"Accept", "Authorization"}
+	if signed {
+		vary = append(vary, signatureKeyIdHeader, signatureTimestampHeader, signatureHeader)
+	}
+	return vary
+}
+
+// computeETag is weak because the validator is computed before compression.
+func computeETag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return `W/"` + base64.RawURLEncoding.EncodeToString(hash[:16]) + `"`
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// responseCache keeps the last response for each GET URL, so that the
+// client can revalidate it with If-None-Match.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+	size    int
+}
+
+type cachedResponse struct {
+	etag        string
+	contentType string
+	body        []byte
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{entries: make(map[string]cachedResponse), size: size}
+}
+
+func (c *responseCache) get(url string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, exists := c.entries[url]
+	return entry, exists
+}
+
+func (c *responseCache) set(url string, entry cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[url]; !exists && len(c.entries) >= c.size {
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[url] = entry
+}
+
+// cacheable reports whether every item of a batch targets one of the routes
+// the client was told are cacheable. Batches with attachments or references
+// are always posted, since get replaces the IDs that references point to.
+func (t *httpTransport) cacheable(requests [][]interface{}) bool {
+	if len(t.cacheableRoutes) == 0 || t.encryption != nil {
+		return false
+	}
+	for _, request := range requests {
+		id, _ := request[0].(string)
+		route, _ := request[1].(string)
+		if id == "" || !t.cacheableRoutes[route] || (len(request) > 2 && (hasAttachments(request[2]) || len(collectRefs(request[2], nil)) > 0)) {
+			return false
+		}
+	}
+	return true
+}
+
+// get sends a batch as a GET request. Item IDs are replaced by their index so
+// that identical batches share a URL, and restored in the results.
+func (t *httpTransport) get(requests [][]interface{}, headers map[string]string, respond func([]interface{})) (bool, error) {
+	ids := make([]interface{}, len(requests))
+	canonical := make([][]interface{}, len(requests))
+	for i, request := range requests {
+		ids[i] = request[0]
+		canonical[i] = append([]interface{}{strconv.Itoa(i)}, request[1:]...)
+	}
+	payload, err := JSONCodec{}.Marshal(canonical)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+	separator := "?"
+	if strings.Contains(t.url, "?") {
+		separator = "&"
+	}
+	url := t.url + separator + batchQueryParam + "=" + encodeBatchQuery(payload)
+	if len(url) > maxGetUrlLength {
+		return false, nil
+	}
+
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return true, fmt.Errorf("failed to create request: %w", err)
+	}
+	accept := JSONCodec{}.ContentType()
+	if t.codec != nil {
+		accept = t.codec.ContentType()
+	}
+	request.Header.Set("Accept", accept)
+	request.Header.Set(versionHeader, strconv.Itoa(ProtocolVersion))
+	if t.compression.enabled {
+		request.Header.Set("Accept-Encoding", t.compression.acceptEncoding())
+	}
+	cached, isCached := t.cache.get(url)
+	if isCached {
+		request.Header.Set("If-None-Match", cached.etag)
+	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	if t.signer != nil {
+		t.signer.sign(request, nil, time.Now())
+	}
+
+	response, err := t.httpClient().Do(request)
+	if err != nil {
+		return true, fmt.Errorf("GET request failed: %w", err)
+	}
+	defer response.Body.Close()
+
+	var body []byte
+	contentType := response.Header.Get("Content-Type")
+	if response.StatusCode == http.StatusNotModified && isCached {
+		body, contentType = cached.body, cached.contentType
+	} else {
+		bodyReader, err := decompressBody(t.compression, response.Header.Get("Content-Encoding"), response.Body)
+		if err != nil {
+			return true, err
+		}
+		body, err = io.ReadAll(bodyReader)
+		if err != nil {
+			return true, fmt.Errorf("failed to read response body: %w", err)
+		}
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return true, parseHttpError(response.StatusCode, body)
+		} else if response.StatusCode == http.StatusNoContent {
+			return true, nil
+		}
+		if etag := response.Header.Get("ETag"); etag != "" {
+			t.cache.set(url, cachedResponse{etag: etag, contentType: contentType, body: body})
+		}
+	}
+
+	return true, t.decodeResults(body, contentType, func(item []interface{}) {
+		if len(item) > 0 {
+			if index, err := strconv.Atoi(fmt.Sprint(item[0])); err == nil && index >= 0 && index < len(ids) {
+				item[0] = ids[index]
+			}
+		}
+		respond(item)
+	})
+}
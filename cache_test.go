@@ -0,0 +1,154 @@
+package blest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheableRequests(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	calls := 0
+	version := "v1"
+
+	router := NewRouter()
+	router.Route("catalog", func(body map[string]interface{}) (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return map[string]interface{}{"version": version, "page": body["page"]}, nil
+	})
+	router.Route("stock", func() (interface{}, error) {
+		return map[string]interface{}{"count": 3}, nil
+	})
+	router.Route("write", func() (interface{}, error) {
+		return map[string]interface{}{"written": true}, nil
+	})
+	router.Route("broken", func() (interface{}, error) {
+		return nil, NewBlestError("Broken", 500)
+	})
+	assert.Nil(t, router.Describe("catalog", map[string]interface{}{"cacheable": true, "maxAge": 60}))
+	assert.Nil(t, router.Describe("stock", map[string]interface{}{"cacheable": true, "maxAge": float64(5)}))
+	assert.Nil(t, router.Describe("broken", map[string]interface{}{"cacheable": true}))
+	assert.NotNil(t, router.Describe("stock", map[string]interface{}{"maxAge": -1}))
+
+	var statusMu sync.Mutex
+	var methods []string
+	var statuses []int
+	handler := router.HttpHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		statusMu.Lock()
+		methods = append(methods, r.Method)
+		statuses = append(statuses, recorder.Code)
+		statusMu.Unlock()
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	}))
+	defer server.Close()
+	lastRequest := func() (string, int) {
+		statusMu.Lock()
+		defer statusMu.Unlock()
+		return methods[len(methods)-1], statuses[len(statuses)-1]
+	}
+
+	client := NewHttpClient(server.URL, map[string]interface{}{"cacheableRoutes": []string{"catalog", "stock", "broken"}})
+
+	// Cacheable batches are sent with GET and revalidated with ETags
+	result, err := client.Request("catalog", map[string]interface{}{"page": float64(1)})
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", result["version"])
+	method, status := lastRequest()
+	assert.Equal(t, "GET", method)
+	assert.Equal(t, 200, status)
+
+	result, err = client.Request("catalog", map[string]interface{}{"page": float64(1)})
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", result["version"])
+	assert.Equal(t, float64(1), result["page"])
+	_, status = lastRequest()
+	assert.Equal(t, 304, status)
+
+	mu.Lock()
+	version = "v2"
+	mu.Unlock()
+	result, err = client.Request("catalog", map[string]interface{}{"page": float64(1)})
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", result["version"])
+	_, status = lastRequest()
+	assert.Equal(t, 200, status)
+
+	// Other routes are still sent with POST
+	_, err = client.Request("write")
+	assert.Nil(t, err)
+	method, _ = lastRequest()
+	assert.Equal(t, "POST", method)
+
+	_, err = client.Request("broken")
+	assert.Equal(t, 500, err.(*BlestError).StatusCode)
+
+	// Batches with references are posted, so their IDs are kept
+	batch := client.Batch()
+	stock := batch.Add("stock")
+	page := batch.Add("catalog", map[string]interface{}{"page": stock.Ref("count")})
+	assert.Nil(t, batch.Send())
+	result, err = page.Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, float64(3), result["page"])
+	method, _ = lastRequest()
+	assert.Equal(t, "POST", method)
+
+	get := func(batch string, header http.Header) *http.Response {
+		request, _ := http.NewRequest("GET", server.URL+"?b="+encodeBatchQuery([]byte(batch)), nil)
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		response, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		return response
+	}
+
+	// The shortest max age in the batch wins and errors are never cached
+	response := get(`[["0","catalog"],["1","stock"]]`, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "public, max-age=5", response.Header.Get("Cache-Control"))
+	etag := response.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	response = get(`[["0","catalog"],["1","stock"]]`, http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, 304, response.StatusCode)
+	response = get(`[["0","broken"]]`, nil)
+	assert.Equal(t, "no-store", response.Header.Get("Cache-Control"))
+
+	// Responses to authenticated requests are only cached by the client
+	response = get(`[["0","catalog"]]`, http.Header{"Authorization": {"Bearer token"}})
+	assert.Equal(t, "private, max-age=60", response.Header.Get("Cache-Control"))
+	assert.Equal(t, "Accept, Authorization", response.Header.Get("Vary"))
+
+	// Routes that are not cacheable cannot be requested with GET
+	response = get(`[["0","catalog"],["1","write"]]`, nil)
+	assert.Equal(t, 405, response.StatusCode)
+	response = get(`not json`, nil)
+	assert.Equal(t, 400, response.StatusCode)
+
+	// Malformed items are rejected before their routes are looked up
+	for _, batch := range []string{`[[]]`, `[["a"]]`, `[null]`, `[["a",1]]`} {
+		response = get(batch, nil)
+		assert.Equal(t, 400, response.StatusCode, batch)
+	}
+
+	assert.True(t, etagMatches(`"abc", W/"def"`, `W/"def"`))
+	assert.True(t, etagMatches(`*`, `W/"def"`))
+	assert.False(t, etagMatches(`"abc"`, `W/"def"`))
+}
@@ -0,0 +1,168 @@
+package blest
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// callGroup shares the result of identical calls, made with the same route,
+// body and headers. Calls made while an identical one is in flight wait for
+// its result instead of taking a slot in the batch, and successful results of
+// routes with a TTL are kept for later calls. Shared results must not be
+// modified.
+type callGroup struct {
+	mu         sync.Mutex
+	coalesce   bool
+	ttls       map[string]time.Duration
+	inFlight   map[string]*sharedCall
+	cache      map[string]*cachedCall
+	generation int
+	lastSweep  time.Time
+}
+
+type sharedCall struct {
+	done   chan struct{}
+	result map[string]interface{}
+	err    error
+}
+
+type cachedCall struct {
+	route   string
+	result  map[string]interface{}
+	expires time.Time
+}
+
+func parseCallGroup(options map[string]interface{}) *callGroup {
+	coalesce := false
+	if options["coalesce"] != nil {
+		c, ok := options["coalesce"].(bool)
+		if !ok {
+			panic("Coalesce should be a boolean")
+		}
+		coalesce = c
+	}
+	ttls := make(map[string]time.Duration)
+	if options["cacheTtl"] != nil {
+		t, ok := options["cacheTtl"].(map[string]int)
+		if !ok {
+			panic("Cache TTL should be a map of routes to milliseconds")
+		}
+		for route, ttl := range t {
+			if ttl <= 0 {
+				panic("Cache TTL should be a positive integer")
+			}
+			ttls[route] = time.Duration(ttl) * time.Millisecond
+		}
+	}
+	if !coalesce && len(ttls) == 0 {
+		return nil
+	}
+	return &callGroup{
+		coalesce:  coalesce,
+		ttls:      ttls,
+		inFlight:  make(map[string]*sharedCall),
+		cache:     make(map[string]*cachedCall),
+		lastSweep: time.Now(),
+	}
+}
+
+// callKey identifies a call by its route, body and headers. Map keys are
+// sorted when marshaled, so equal maps give equal keys.
+func callKey(call *Call) (string, bool) {
+	data, err := json.Marshal([]interface{}{call.Route, call.Body, call.Headers})
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+func (g *callGroup) do(call *Call, next func(call *Call) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	key, ok := callKey(call)
+	if !ok {
+		return next(call)
+	}
+	ttl := g.ttls[call.Route]
+
+	g.mu.Lock()
+	now := time.Now()
+	if entry, exists := g.cache[key]; exists {
+		if now.Before(entry.expires) {
+			g.mu.Unlock()
+			return entry.result, nil
+		}
+		delete(g.cache, key)
+	}
+	if shared, exists := g.inFlight[key]; exists {
+		g.mu.Unlock()
+		<-shared.done
+		return shared.result, shared.err
+	}
+	var shared *sharedCall
+	if g.coalesce {
+		shared = &sharedCall{done: make(chan struct{})}
+		g.inFlight[key] = shared
+	}
+	generation := g.generation
+	g.mu.Unlock()
+
+	result, err := next(call)
+
+	g.mu.Lock()
+	// A result that was in flight while the cache was invalidated may be
+	// stale, so it is not kept
+	if err == nil && ttl > 0 && generation == g.generation {
+		g.sweep(now)
+		g.cache[key] = &cachedCall{route: call.Route, result: result, expires: time.Now().Add(ttl)}
+	}
+	if shared != nil {
+		delete(g.inFlight, key)
+	}
+	g.mu.Unlock()
+	if shared != nil {
+		shared.result, shared.err = result, err
+		close(shared.done)
+	}
+	return result, err
+}
+
+// sweep drops expired results at most once a second. It must be called with
+// the lock held.
+func (g *callGroup) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Second {
+		return
+	}
+	for key, entry := range g.cache {
+		if now.After(entry.expires) {
+			delete(g.cache, key)
+		}
+	}
+	g.lastSweep = now
+}
+
+func (g *callGroup) invalidate(routes []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.generation++
+	if len(routes) == 0 {
+		g.cache = make(map[string]*cachedCall)
+		return
+	}
+	drop := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		drop[route] = true
+	}
+	for key, entry := range g.cache {
+		if drop[entry.route] {
+			delete(g.cache, key)
+		}
+	}
+}
+
+// Invalidate drops the cached results of the given routes, or of every route
+// when none is given.
+func (c *HttpClient) Invalidate(routes ...string) {
+	if c.calls != nil {
+		c.calls.invalidate(routes)
+	}
+}
@@ -0,0 +1,94 @@
+package blest
+
+import (
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalescing(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	router := NewRouter()
+	router.Route("user", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return map[string]interface{}{"id": body["id"], "calls": float64(calls.Load())}, nil
+	})
+	router.Route("fail", func() (interface{}, error) {
+		calls.Add(1)
+		return nil, NewBlestError("Failed", 500)
+	})
+
+	var items atomic.Int32
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+
+	client := NewHttpClient(server.URL, map[string]interface{}{
+		"coalesce": true,
+		"cacheTtl": map[string]int{"user": 300},
+	})
+	client.Use(func(requests [][]interface{}, headers map[string]string, next func([][]interface{}, map[string]string) error) error {
+		items.Add(int32(len(requests)))
+		return next(requests, headers)
+	})
+
+	// Identical calls in flight share a single batch item
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := client.Request("user", map[string]interface{}{"id": "a"})
+			assert.Nil(t, err)
+			assert.Equal(t, "a", result["id"])
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, int32(1), items.Load())
+
+	// Other bodies or headers are separate calls
+	client.Request("user", map[string]interface{}{"id": "b"})
+	client.Request("user", map[string]interface{}{"id": "a"}, map[string]interface{}{"traceId": "x"})
+	assert.Equal(t, int32(3), calls.Load())
+
+	// Cached results are served until they expire or are invalidated
+	result, err := client.Request("user", map[string]interface{}{"id": "a"})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), result["calls"])
+	assert.Equal(t, int32(3), calls.Load())
+
+	client.Invalidate("other")
+	client.Request("user", map[string]interface{}{"id": "a"})
+	assert.Equal(t, int32(3), calls.Load())
+	client.Invalidate("user")
+	client.Request("user", map[string]interface{}{"id": "a"})
+	assert.Equal(t, int32(4), calls.Load())
+	client.Invalidate()
+	client.Request("user", map[string]interface{}{"id": "a"})
+	assert.Equal(t, int32(5), calls.Load())
+
+	time.Sleep(350 * time.Millisecond)
+	client.Request("user", map[string]interface{}{"id": "a"})
+	assert.Equal(t, int32(6), calls.Load())
+
+	// Errors and routes without a TTL are not cached
+	client.Request("fail")
+	_, err = client.Request("fail")
+	assert.Equal(t, 500, err.(*BlestError).StatusCode)
+	assert.Equal(t, int32(8), calls.Load())
+
+	assert.Nil(t, parseCallGroup(nil))
+	assert.Panics(t, func() {
+		parseCallGroup(map[string]interface{}{"cacheTtl": map[string]int{"user": 0}})
+	})
+	assert.Panics(t, func() {
+		parseCallGroup(map[string]interface{}{"coalesce": "yes"})
+	})
+}
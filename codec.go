@@ -0,0 +1,154 @@
+package blest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes and decodes batches for a single wire format, selected by
+// the Content-Type and Accept headers.
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec decodes numbers as float64, or as json.Number when UseNumber is
+// set so that large integers keep their precision.
+type JSONCodec struct {
+	UseNumber bool
+}
+
+func (c JSONCodec) ContentType() string {
+	return "application/json"
+}
+
+func (c JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	if !c.UseNumber {
+		return json.Unmarshal(data, v)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("invalid data after top-level value")
+	}
+	return nil
+}
+
+// MsgpackCodec decodes integers as int64 or uint64 rather than float64.
+type MsgpackCodec struct{}
+
+func (c MsgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (c MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (c MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.UseLooseInterfaceDecoding(true)
+	return decoder.Decode(v)
+}
+
+// CBORCodec decodes integers as int64 rather than float64, or as *big.Int
+// when they do not fit.
+type CBORCodec struct{}
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	IntDec:         cbor.IntDecConvertSignedOrBigInt,
+}.DecMode()
+
+func (c CBORCodec) ContentType() string {
+	return "application/cbor"
+}
+
+func (c CBORCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (c CBORCodec) Unmarshal(data []byte, v interface{}) error {
+	return cborDecMode.Unmarshal(data, v)
+}
+
+var defaultCodecs = []Codec{JSONCodec{}, MsgpackCodec{}, CBORCodec{}}
+
+// parseCodecs returns the configured codecs followed by the defaults they do
+// not replace.
+func parseCodecs(options map[string]interface{}) []Codec {
+	var codecs []Codec
+	if custom, ok := options["codecs"].([]Codec); ok {
+		codecs = append(codecs, custom...)
+	}
+	if codec, ok := options["codec"].(Codec); ok {
+		codecs = append(codecs, codec)
+	}
+	if useNumber, _ := options["useNumber"].(bool); useNumber && findCodec(codecs, "application/json") == nil {
+		codecs = append(codecs, JSONCodec{UseNumber: true})
+	}
+	for _, codec := range defaultCodecs {
+		if findCodec(codecs, codec.ContentType()) == nil {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+func findCodec(codecs []Codec, contentType string) Codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	for _, codec := range codecs {
+		if codec.ContentType() == mediaType {
+			return codec
+		}
+	}
+	return nil
+}
+
+// negotiateCodec picks the preferred codec from an Accept header, falling
+// back to the codec the request was sent with.
+func negotiateCodec(codecs []Codec, accept string, fallback Codec) Codec {
+	var best Codec
+	bestQuality := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+		if quality <= bestQuality {
+			continue
+		}
+		if mediaType == "*/*" || mediaType == "application/*" {
+			best, bestQuality = fallback, quality
+		} else if codec := findCodec(codecs, mediaType); codec != nil {
+			best, bestQuality = codec, quality
+		}
+	}
+	if best == nil {
+		return fallback
+	}
+	return best
+}
@@ -0,0 +1,80 @@
+package blest
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	const bigID = int64(1<<60 + 1)
+
+	router := NewRouter()
+	router.Route("echoRoute", func(body map[string]interface{}) (interface{}, error) {
+		return body, nil
+	})
+	router.Route("idRoute", func(body map[string]interface{}) (interface{}, error) {
+		id, ok := body["id"].(int64)
+		if !ok || id != bigID {
+			return nil, NewBlestError("Wrong ID", 400, "WRONG_ID")
+		}
+		return map[string]interface{}{"id": id}, nil
+	})
+
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+
+	for _, codec := range []Codec{MsgpackCodec{}, CBORCodec{}} {
+		client := NewHttpClient(server.URL, map[string]interface{}{"codec": codec})
+
+		// Integers keep their precision both ways
+		result, err := client.Request("idRoute", map[string]interface{}{"id": bigID})
+		assert.Nil(t, err, codec.ContentType())
+		assert.EqualValues(t, bigID, result["id"], codec.ContentType())
+
+		result, err = client.Request("echoRoute", map[string]interface{}{"nested": map[string]interface{}{"list": []interface{}{"a", "b"}}})
+		assert.Nil(t, err, codec.ContentType())
+		assert.Equal(t, []interface{}{"a", "b"}, result["nested"].(map[string]interface{})["list"], codec.ContentType())
+
+		// Item errors are decoded too
+		_, err = client.Request("idRoute", map[string]interface{}{"id": 1})
+		blestErr, ok := err.(*BlestError)
+		assert.True(t, ok, codec.ContentType())
+		assert.Equal(t, 400, blestErr.StatusCode, codec.ContentType())
+		assert.Equal(t, "WRONG_ID", blestErr.Code, codec.ContentType())
+	}
+
+	// The response codec follows the Accept header
+	request, _ := http.NewRequest("POST", server.URL, strings.NewReader(`[["a","echoRoute",{"hello":"world"}]]`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json;q=0.5, application/cbor")
+	response, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "application/cbor", response.Header.Get("Content-Type"))
+	var buffer bytes.Buffer
+	buffer.ReadFrom(response.Body)
+	response.Body.Close()
+	var result [][]interface{}
+	assert.Nil(t, CBORCodec{}.Unmarshal(buffer.Bytes(), &result))
+	assert.Equal(t, "world", result[0][2].(map[string]interface{})["hello"])
+
+	// Unknown content types are parsed as JSON
+	request, _ = http.NewRequest("POST", server.URL, strings.NewReader(`[["a","echoRoute"]]`))
+	request.Header.Set("Content-Type", "text/plain")
+	response, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	response.Body.Close()
+
+	codecs := parseCodecs(nil)
+	assert.Equal(t, "application/msgpack", negotiateCodec(codecs, "application/msgpack", JSONCodec{}).ContentType())
+	assert.Equal(t, "application/json", negotiateCodec(codecs, "*/*", JSONCodec{}).ContentType())
+	assert.Equal(t, "application/json", negotiateCodec(codecs, "text/html", JSONCodec{}).ContentType())
+}
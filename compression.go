@@ -0,0 +1,209 @@
+package blest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultCompressionThreshold = 1024
+
+// ContentEncoder compresses and decompresses HTTP bodies for a single
+// Content-Encoding token. Implement it to add encodings such as br or zstd.
+type ContentEncoder interface {
+	Encoding() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type GzipEncoder struct {
+	Level int
+}
+
+func (e GzipEncoder) Encoding() string {
+	return "gzip"
+}
+
+func (e GzipEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if e.Level == 0 {
+		return gzip.NewWriter(w), nil
+	}
+	return gzip.NewWriterLevel(w, e.Level)
+}
+
+func (e GzipEncoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// DeflateEncoder implements the HTTP "deflate" encoding, which is the zlib
+// format rather than a raw deflate stream.
+type DeflateEncoder struct {
+	Level int
+}
+
+func (e DeflateEncoder) Encoding() string {
+	return "deflate"
+}
+
+func (e DeflateEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if e.Level == 0 {
+		return zlib.NewWriter(w), nil
+	}
+	return zlib.NewWriterLevel(w, e.Level)
+}
+
+func (e DeflateEncoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+type compressionConfig struct {
+	encoders  []ContentEncoder
+	enabled   bool
+	threshold int
+	request   ContentEncoder
+}
+
+func parseCompressionConfig(options map[string]interface{}) compressionConfig {
+	config := compressionConfig{
+		enabled:   true,
+		threshold: defaultCompressionThreshold,
+	}
+	if custom, ok := options["encoders"].([]ContentEncoder); ok {
+		config.encoders = append(config.encoders, custom...)
+	}
+	for _, encoder := range []ContentEncoder{GzipEncoder{}, DeflateEncoder{}} {
+		if config.encoder(encoder.Encoding()) == nil {
+			config.encoders = append(config.encoders, encoder)
+		}
+	}
+	switch compression := options["compression"].(type) {
+	case bool:
+		config.enabled = compression
+	case string:
+		config.request = config.encoder(compression)
+		if config.request == nil {
+			panic(fmt.Sprintf("Unsupported compression: %s", compression))
+		}
+	}
+	if options["compressionThreshold"] != nil {
+		threshold, ok := options["compressionThreshold"].(int)
+		if !ok || threshold < 0 {
+			panic("compressionThreshold should be a positive integer")
+		}
+		config.threshold = threshold
+	}
+	return config
+}
+
+func (c compressionConfig) encoder(encoding string) ContentEncoder {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	for _, encoder := range c.encoders {
+		if strings.ToLower(encoder.Encoding()) == encoding {
+			return encoder
+		}
+	}
+	return nil
+}
+
+func (c compressionConfig) acceptEncoding() string {
+	encodings := make([]string, len(c.encoders))
+	for i, encoder := range c.encoders {
+		encodings[i] = encoder.Encoding()
+	}
+	return strings.Join(encodings, ", ")
+}
+
+// negotiate picks the encoder with the highest quality value in an
+// Accept-Encoding header, breaking ties by the configured encoder order.
+func (c compressionConfig) negotiate(acceptEncoding string) ContentEncoder {
+	if !c.enabled || acceptEncoding == "" {
+		return nil
+	}
+	type candidate struct {
+		encoder ContentEncoder
+		quality float64
+		index   int
+	}
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		qualities[name] = quality
+	}
+	var candidates []candidate
+	for i, encoder := range c.encoders {
+		quality, ok := qualities[strings.ToLower(encoder.Encoding())]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+		if ok && quality > 0 {
+			candidates = append(candidates, candidate{encoder, quality, i})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+	return candidates[0].encoder
+}
+
+func compressBody(encoder ContentEncoder, body []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := encoder.NewWriter(&buffer)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(body); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// decompressBody wraps body according to a Content-Encoding header, which
+// may list several encodings in the order they were applied.
+func decompressBody(config compressionConfig, contentEncoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	if contentEncoding == "" {
+		return body, nil
+	}
+	encodings := strings.Split(contentEncoding, ",")
+	reader := body
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		if encoding == "" || encoding == "identity" {
+			continue
+		}
+		encoder := config.encoder(encoding)
+		if encoder == nil {
+			return nil, &BlestError{Message: fmt.Sprintf("Unsupported content encoding: %s", encoding), StatusCode: 415, Code: "UNSUPPORTED_ENCODING"}
+		}
+		decoded, err := encoder.NewReader(reader)
+		if err != nil {
+			return nil, &BlestError{Message: "Failed to decompress request body", StatusCode: 400, Code: "INVALID_ENCODING"}
+		}
+		reader = decoded
+	}
+	return reader, nil
+}
@@ -0,0 +1,140 @@
+package blest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type reverseEncoder struct{}
+
+func (e reverseEncoder) Encoding() string {
+	return "x-reverse"
+}
+
+func (e reverseEncoder) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return &reverseWriter{w: w}, nil
+}
+
+func (e reverseEncoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(reverseBytes(data))), nil
+}
+
+type reverseWriter struct {
+	w      io.Writer
+	buffer bytes.Buffer
+}
+
+func (rw *reverseWriter) Write(p []byte) (int, error) {
+	return rw.buffer.Write(p)
+}
+
+func (rw *reverseWriter) Close() error {
+	_, err := rw.w.Write(reverseBytes(rw.buffer.Bytes()))
+	return err
+}
+
+func reverseBytes(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i, b := range data {
+		reversed[len(data)-1-i] = b
+	}
+	return reversed
+}
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+
+	config := parseCompressionConfig(map[string]interface{}{"encoders": []ContentEncoder{reverseEncoder{}}})
+	assert.Equal(t, "x-reverse", config.negotiate("gzip, x-reverse").Encoding())
+	assert.Equal(t, "gzip", config.negotiate("gzip, x-reverse;q=0.5").Encoding())
+	assert.Equal(t, "deflate", config.negotiate("deflate, gzip;q=0").Encoding())
+	assert.Equal(t, "x-reverse", config.negotiate("*").Encoding())
+	assert.Nil(t, config.negotiate("br"))
+	assert.Nil(t, config.negotiate(""))
+	assert.Nil(t, parseCompressionConfig(map[string]interface{}{"compression": false}).negotiate("gzip"))
+
+	router := NewRouter()
+	router.Route("echoRoute", func(body map[string]interface{}) (interface{}, error) {
+		return body, nil
+	})
+
+	server := httptest.NewServer(NewHttpHandler(router.Handle, map[string]interface{}{
+		"compressionThreshold": 64,
+		"encoders":             []ContentEncoder{reverseEncoder{}},
+	}))
+	defer server.Close()
+
+	post := func(payload []byte, contentEncoding string, acceptEncoding string) *http.Response {
+		request, _ := http.NewRequest("POST", server.URL, bytes.NewReader(payload))
+		request.Header.Set("Content-Type", "application/json")
+		if contentEncoding != "" {
+			request.Header.Set("Content-Encoding", contentEncoding)
+		}
+		request.Header.Set("Accept-Encoding", acceptEncoding)
+		response, err := http.DefaultTransport.RoundTrip(request)
+		assert.Nil(t, err)
+		return response
+	}
+
+	largeBatch := []byte(`[["a","echoRoute",{"value":"` + strings.Repeat("x", 100) + `"}]]`)
+	smallBatch := []byte(`[["a","echoRoute",{"value":"x"}]]`)
+
+	// Large responses are compressed
+	response := post(largeBatch, "", "gzip")
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "gzip", response.Header.Get("Content-Encoding"))
+	assert.Contains(t, response.Header.Values("Vary"), "Accept-Encoding")
+	reader, err := gzip.NewReader(response.Body)
+	assert.Nil(t, err)
+	var result [][]interface{}
+	assert.Nil(t, json.NewDecoder(reader).Decode(&result))
+	response.Body.Close()
+	assert.Equal(t, strings.Repeat("x", 100), result[0][2].(map[string]interface{})["value"])
+
+	// Small responses are not
+	response = post(smallBatch, "", "gzip")
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "", response.Header.Get("Content-Encoding"))
+	response.Body.Close()
+
+	// Custom encoders are negotiated
+	response = post(largeBatch, "", "x-reverse")
+	assert.Equal(t, "x-reverse", response.Header.Get("Content-Encoding"))
+	response.Body.Close()
+
+	// Compressed request bodies are decompressed
+	var buffer bytes.Buffer
+	writer := zlib.NewWriter(&buffer)
+	writer.Write(smallBatch)
+	writer.Close()
+	response = post(buffer.Bytes(), "deflate", "")
+	assert.Equal(t, 200, response.StatusCode)
+	response.Body.Close()
+
+	response = post(smallBatch, "br", "")
+	assert.Equal(t, 415, response.StatusCode)
+	response.Body.Close()
+
+	// The client compresses requests and decompresses responses
+	client := NewHttpClient(server.URL, map[string]interface{}{"compression": "gzip", "compressionThreshold": 0})
+	clientResult, err := client.Request("echoRoute", map[string]interface{}{"value": strings.Repeat("y", 200)})
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("y", 200), clientResult["value"])
+
+	assert.Panics(t, func() {
+		NewHttpClient(server.URL, map[string]interface{}{"compression": "br"})
+	})
+}
@@ -0,0 +1,243 @@
+package blest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const encryptedContentType = "application/blest-encrypted+json"
+
+const (
+	encryptionRequest  = "request"
+	encryptionResponse = "response"
+)
+
+// encryptedEnvelope carries a batch sealed with AES-GCM. ContentType names
+// the codec of the plaintext, and Epk is the ephemeral X25519 public key of
+// a client that does not use a pre-shared key.
+type encryptedEnvelope struct {
+	KeyID       string `json:"kid"`
+	Epk         []byte `json:"epk,omitempty"`
+	ContentType string `json:"cty"`
+	Nonce       []byte `json:"nonce"`
+	Ciphertext  []byte `json:"ciphertext"`
+}
+
+// encryptionSession seals and opens the two halves of one exchange with the
+// same key. The direction is authenticated so that a request can never be
+// replayed as its own response.
+type encryptionSession struct {
+	keyID string
+	epk   []byte
+	aead  cipher.AEAD
+}
+
+func newEncryptionSession(keyID string, epk []byte, key []byte) (*encryptionSession, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionSession{keyID: keyID, epk: epk, aead: aead}, nil
+}
+
+func encryptionAdditionalData(direction, keyID, contentType string) []byte {
+	return []byte(direction + "\x00" + keyID + "\x00" + contentType)
+}
+
+func (s *encryptionSession) seal(direction, contentType string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	envelope := encryptedEnvelope{
+		KeyID:       s.keyID,
+		ContentType: contentType,
+		Nonce:       nonce,
+		Ciphertext:  s.aead.Seal(nil, nonce, plaintext, encryptionAdditionalData(direction, s.keyID, contentType)),
+	}
+	if direction == encryptionRequest {
+		envelope.Epk = s.epk
+	}
+	return json.Marshal(envelope)
+}
+
+func (s *encryptionSession) open(direction string, envelope encryptedEnvelope) ([]byte, error) {
+	if envelope.KeyID != s.keyID || len(envelope.Nonce) != s.aead.NonceSize() {
+		return nil, errors.New("invalid encrypted payload")
+	}
+	return s.aead.Open(nil, envelope.Nonce, envelope.Ciphertext, encryptionAdditionalData(direction, envelope.KeyID, envelope.ContentType))
+}
+
+func parseEnvelope(data []byte) (encryptedEnvelope, error) {
+	var envelope encryptedEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return envelope, err
+	}
+	if envelope.KeyID == "" || envelope.ContentType == "" {
+		return envelope, errors.New("invalid encrypted payload")
+	}
+	return envelope, nil
+}
+
+// deriveKey expands an X25519 shared secret into an AES-256 key with
+// HKDF-SHA256, salted with both public keys.
+func deriveKey(sharedSecret, clientPublicKey, serverPublicKey []byte) []byte {
+	extract := hmac.New(sha256.New, append(append([]byte{}, clientPublicKey...), serverPublicKey...))
+	extract.Write(sharedSecret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte("blest encryption\x01"))
+	return expand.Sum(nil)
+}
+
+func validateEncryptionKey(key []byte) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		panic("Encryption keys should be 16, 24 or 32 bytes")
+	}
+}
+
+// encryptionConfig holds the keys a server accepts, by key ID. Each key is
+// either a pre-shared AES key or an X25519 private key, so that keys can be
+// rotated by adding the new one before clients switch to it.
+type encryptionConfig struct {
+	keys     map[string]interface{}
+	required bool
+}
+
+func parseEncryptionConfig(options map[string]interface{}) *encryptionConfig {
+	keys := make(map[string]interface{})
+	switch k := options["encryptionKeys"].(type) {
+	case nil:
+	case map[string][]byte:
+		for keyID, key := range k {
+			keys[keyID] = key
+		}
+	case map[string]*ecdh.PrivateKey:
+		for keyID, key := range k {
+			keys[keyID] = key
+		}
+	case map[string]interface{}:
+		for keyID, key := range k {
+			keys[keyID] = key
+		}
+	default:
+		panic("Encryption keys should be a map of key IDs to keys")
+	}
+	for keyID, key := range keys {
+		if keyID == "" {
+			panic("Encryption key IDs should not be empty")
+		}
+		switch k := key.(type) {
+		case []byte:
+			validateEncryptionKey(k)
+		case *ecdh.PrivateKey:
+			if k.Curve() != ecdh.X25519() {
+				panic("Encryption private keys should be X25519 keys")
+			}
+		default:
+			panic("Encryption keys should be byte slices or X25519 private keys")
+		}
+	}
+	required, _ := options["requireEncryption"].(bool)
+	if required && len(keys) == 0 {
+		panic("Encryption keys are required when encryption is required")
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return &encryptionConfig{keys: keys, required: required}
+}
+
+// open decrypts a request envelope and returns the session to encrypt the
+// response with.
+func (c *encryptionConfig) open(data []byte) ([]byte, string, *encryptionSession, *BlestError) {
+	envelope, err := parseEnvelope(data)
+	if err != nil {
+		return nil, "", nil, &BlestError{Message: "Failed to parse encrypted payload", StatusCode: 400, Code: "INVALID_ENCRYPTION"}
+	}
+	var key []byte
+	switch k := c.keys[envelope.KeyID].(type) {
+	case []byte:
+		key = k
+	case *ecdh.PrivateKey:
+		clientPublicKey, err := ecdh.X25519().NewPublicKey(envelope.Epk)
+		if err != nil {
+			return nil, "", nil, &BlestError{Message: "Invalid ephemeral public key", StatusCode: 400, Code: "INVALID_ENCRYPTION"}
+		}
+		sharedSecret, err := k.ECDH(clientPublicKey)
+		if err != nil {
+			return nil, "", nil, &BlestError{Message: "Invalid ephemeral public key", StatusCode: 400, Code: "INVALID_ENCRYPTION"}
+		}
+		key = deriveKey(sharedSecret, envelope.Epk, k.PublicKey().Bytes())
+	default:
+		return nil, "", nil, &BlestError{Message: fmt.Sprintf("Unknown encryption key: %s", envelope.KeyID), StatusCode: 400, Code: "UNKNOWN_KEY"}
+	}
+	session, err := newEncryptionSession(envelope.KeyID, nil, key)
+	if err != nil {
+		return nil, "", nil, &BlestError{Message: err.Error(), StatusCode: 500, Code: "INTERNAL_SERVER_ERROR"}
+	}
+	plaintext, err := session.open(encryptionRequest, envelope)
+	if err != nil {
+		return nil, "", nil, &BlestError{Message: "Failed to decrypt request body", StatusCode: 400, Code: "DECRYPTION_FAILED"}
+	}
+	return plaintext, envelope.ContentType, session, nil
+}
+
+// clientEncryption holds the key a client encrypts with: a pre-shared AES
+// key, or the X25519 public key of the server, in which case every request
+// uses a fresh ephemeral key pair.
+type clientEncryption struct {
+	keyID     string
+	key       []byte
+	publicKey *ecdh.PublicKey
+}
+
+func parseClientEncryption(options map[string]interface{}) *clientEncryption {
+	if options["encryptionKey"] == nil {
+		return nil
+	}
+	keyID, _ := options["encryptionKeyId"].(string)
+	if keyID == "" {
+		panic("Encryption key ID is required")
+	}
+	switch k := options["encryptionKey"].(type) {
+	case []byte:
+		validateEncryptionKey(k)
+		return &clientEncryption{keyID: keyID, key: k}
+	case *ecdh.PublicKey:
+		if k.Curve() != ecdh.X25519() {
+			panic("Encryption public keys should be X25519 keys")
+		}
+		return &clientEncryption{keyID: keyID, publicKey: k}
+	default:
+		panic("Encryption key should be a byte slice or an X25519 public key")
+	}
+}
+
+func (c *clientEncryption) newSession() (*encryptionSession, error) {
+	if c.publicKey == nil {
+		return newEncryptionSession(c.keyID, nil, c.key)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := ephemeral.ECDH(c.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	epk := ephemeral.PublicKey().Bytes()
+	return newEncryptionSession(c.keyID, epk, deriveKey(sharedSecret, epk, c.publicKey.Bytes()))
+}
@@ -0,0 +1,119 @@
+package blest
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryption(t *testing.T) {
+	t.Parallel()
+
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 16)
+	serverKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	router := NewRouter(map[string]interface{}{
+		"encryptionKeys": map[string]interface{}{
+			"old": oldKey,
+			"new": newKey,
+			"x":   serverKey,
+		},
+		"requireEncryption": true,
+	})
+	router.Route("echoRoute", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"body": body, "keyId": context["encryptionKeyId"]}, nil
+	})
+
+	// The response is captured so that it can be checked for plaintext
+	var mu sync.Mutex
+	var lastResponse []byte
+	handler := router.HttpHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		mu.Lock()
+		lastResponse = recorder.Body.Bytes()
+		mu.Unlock()
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	}))
+	defer server.Close()
+
+	// Both pre-shared keys are accepted while the key is rotated
+	for _, keyID := range []string{"old", "new"} {
+		key := oldKey
+		if keyID == "new" {
+			key = newKey
+		}
+		client := NewHttpClient(server.URL, map[string]interface{}{"encryptionKeyId": keyID, "encryptionKey": key})
+		result, err := client.Request("echoRoute", map[string]interface{}{"secret": "swordfish"})
+		assert.Nil(t, err, keyID)
+		assert.Equal(t, "swordfish", result["body"].(map[string]interface{})["secret"], keyID)
+		assert.Equal(t, keyID, result["keyId"], keyID)
+		mu.Lock()
+		assert.False(t, bytes.Contains(lastResponse, []byte("swordfish")), keyID)
+		mu.Unlock()
+	}
+
+	// X25519 clients only need the public key of the server
+	client := NewHttpClient(server.URL, map[string]interface{}{"encryptionKeyId": "x", "encryptionKey": serverKey.PublicKey(), "codec": CBORCodec{}})
+	result, err := client.Request("echoRoute", map[string]interface{}{"secret": "swordfish"})
+	assert.Nil(t, err)
+	assert.Equal(t, "swordfish", result["body"].(map[string]interface{})["secret"])
+	assert.Equal(t, "x", result["keyId"])
+
+	// Unknown keys, wrong keys and plaintext are rejected
+	client = NewHttpClient(server.URL, map[string]interface{}{"encryptionKeyId": "retired", "encryptionKey": oldKey})
+	_, err = client.Request("echoRoute")
+	assert.Equal(t, "UNKNOWN_KEY", err.(*BlestError).Code)
+
+	client = NewHttpClient(server.URL, map[string]interface{}{"encryptionKeyId": "old", "encryptionKey": newKey})
+	_, err = client.Request("echoRoute")
+	assert.Equal(t, "DECRYPTION_FAILED", err.(*BlestError).Code)
+
+	client = NewHttpClient(server.URL)
+	_, err = client.Request("echoRoute")
+	assert.Equal(t, "ENCRYPTION_REQUIRED", err.(*BlestError).Code)
+
+	// Servers without keys refuse encrypted requests
+	plainServer := httptest.NewServer(NewRouter().HttpHandler())
+	defer plainServer.Close()
+	response, err := http.Post(plainServer.URL, encryptedContentType, strings.NewReader(`{}`))
+	assert.Nil(t, err)
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.StatusCode)
+
+	// A request envelope cannot be passed off as a response
+	session, err := newEncryptionSession("old", nil, oldKey)
+	assert.Nil(t, err)
+	sealed, err := session.seal(encryptionRequest, "application/json", []byte(`[]`))
+	assert.Nil(t, err)
+	envelope, err := parseEnvelope(sealed)
+	assert.Nil(t, err)
+	_, err = session.open(encryptionResponse, envelope)
+	assert.NotNil(t, err)
+	opened, err := session.open(encryptionRequest, envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(`[]`), opened)
+
+	assert.Panics(t, func() {
+		NewHttpClient(server.URL, map[string]interface{}{"encryptionKeyId": "short", "encryptionKey": []byte("short")})
+	})
+	assert.Panics(t, func() {
+		NewHttpHandler(nil, map[string]interface{}{"requireEncryption": true})
+	})
+}
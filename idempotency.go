@@ -0,0 +1,190 @@
+package blest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader is the request item header that carries an
+// idempotency key.
+const idempotencyKeyHeader = "idempotencyKey"
+
+const (
+	idempotencyContextKey      = "idempotencyStore"
+	idempotencyScopeContextKey = "idempotencyScope"
+)
+
+// IdempotentResult is the stored outcome of a request with an idempotency
+// key, returned again for every retry that carries the same key and the same
+// body and headers, as recorded in its fingerprint.
+type IdempotentResult struct {
+	Result      interface{}
+	Error       interface{}
+	Fingerprint string
+}
+
+// IdempotencyScope returns the caller a request belongs to, from its
+// context. Idempotency keys are only shared by requests with the same
+// scope. Without a scope, keys are shared by every caller of a route, so a
+// caller that knows the key of another gets its result.
+type IdempotencyScope func(context map[string]interface{}) string
+
+// IdempotencyStore deduplicates requests by idempotency key. Reserve claims a
+// key for a new request, or reports that it was already claimed along with
+// the stored result, which is nil while the first request is still running.
+// Complete stores the result of a claimed key, and Release gives the key up
+// so that the request can be retried.
+type IdempotencyStore interface {
+	Reserve(key string) (*IdempotentResult, bool, error)
+	Complete(key string, result IdempotentResult) error
+	Release(key string) error
+}
+
+// MemoryIdempotencyStore keeps idempotency keys in memory for ttl after they
+// were reserved.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	result  *IdempotentResult
+	expires time.Time
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	if ttl <= 0 {
+		panic("TTL should be positive")
+	}
+	return &MemoryIdempotencyStore{
+		ttl:       ttl,
+		entries:   make(map[string]*idempotencyEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(key string) (*IdempotentResult, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > s.ttl {
+		for k, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	if entry, exists := s.entries[key]; exists && now.Before(entry.expires) {
+		return entry.result, false, nil
+	}
+	s.entries[key] = &idempotencyEntry{expires: now.Add(s.ttl)}
+	return nil, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(key string, result IdempotentResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.entries[key]
+	if !exists {
+		return errors.New("idempotency key is not reserved")
+	}
+	entry.result = &result
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func idempotencyKey(headers interface{}) string {
+	h, _ := headers.(map[string]interface{})
+	key, _ := h[idempotencyKeyHeader].(string)
+	return key
+}
+
+// withIdempotencyStore adds the store and its scope to a copy of the batch
+// context, where handleRequestStream looks for them.
+func withIdempotencyStore(context map[string]interface{}, store IdempotencyStore, scope IdempotencyScope) map[string]interface{} {
+	if store == nil {
+		return context
+	}
+	withStore := make(map[string]interface{}, len(context)+2)
+	for key, value := range context {
+		withStore[key] = value
+	}
+	withStore[idempotencyContextKey] = store
+	if scope != nil {
+		withStore[idempotencyScopeContextKey] = scope
+	}
+	return withStore
+}
+
+// idempotencyFingerprint hashes the body and headers of a request, so that a
+// key reused for a different request can be told apart from a retry.
+func idempotencyFingerprint(request requestObject) (string, error) {
+	encoded, err := json.Marshal([]interface{}{request.Body, request.Headers})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(encoded)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// runIdempotent runs a request at most once per scope, route and idempotency
+// key. Server errors release the key, so that a retry can run the request
+// again, and a key reused with a different body or headers is rejected.
+func runIdempotent(store IdempotencyStore, key string, p preparedRequest, emit func([4]interface{})) {
+	id, route := p.request.ID, p.request.Route
+	scopedKey := route + "\x00" + key
+	if scope, ok := p.context[idempotencyScopeContextKey].(IdempotencyScope); ok {
+		scopedKey = scope(p.context) + "\x00" + scopedKey
+	}
+
+	fingerprint, err := idempotencyFingerprint(p.request)
+	if err != nil {
+		emit([4]interface{}{id, route, nil, map[string]interface{}{"message": err.Error(), "statusCode": 500}})
+		return
+	}
+	stored, claimed, err := store.Reserve(scopedKey)
+	if err != nil {
+		emit([4]interface{}{id, route, nil, map[string]interface{}{"message": err.Error(), "statusCode": 500}})
+		return
+	} else if !claimed && stored == nil {
+		emit([4]interface{}{id, route, nil, map[string]interface{}{"message": "A request with this idempotency key is in progress", "statusCode": 409, "code": "IDEMPOTENCY_CONFLICT"}})
+		return
+	} else if !claimed && stored.Fingerprint != fingerprint {
+		emit([4]interface{}{id, route, nil, map[string]interface{}{"message": "The idempotency key was already used for a different request", "statusCode": 422, "code": "IDEMPOTENCY_KEY_REUSED"}})
+		return
+	} else if !claimed {
+		emit([4]interface{}{id, route, stored.Result, stored.Error})
+		return
+	}
+
+	for result := range routeReducer(p.handler, p.request, p.context, p.timeout) {
+		serverError := false
+		if errorObject, ok := result[3].(map[string]interface{}); ok {
+			statusCode, ok := intValue(errorObject["statusCode"])
+			serverError = !ok || statusCode >= 500
+		}
+		if serverError {
+			err = store.Release(scopedKey)
+		} else {
+			err = store.Complete(scopedKey, IdempotentResult{Result: result[2], Error: result[3], Fingerprint: fingerprint})
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		emit(result)
+	}
+}
@@ -0,0 +1,63 @@
+package blest
+
+// Call is a single request as seen by request interceptors, which may change
+// its body and headers before passing it on.
+type Call struct {
+	Route   string
+	Body    map[string]interface{}
+	Headers map[string]interface{}
+}
+
+// RequestInterceptor wraps every call to Request and Notify. It runs before
+// the call is queued, can fail it early by returning without calling next,
+// and sees the result or error once next returns. Notifications have a nil
+// result.
+type RequestInterceptor func(call *Call, next func(call *Call) (map[string]interface{}, error)) (map[string]interface{}, error)
+
+// BatchInterceptor wraps every batch the client sends. It can change the
+// items or the HTTP headers of the batch, fail the whole batch early by
+// returning without calling next, and sees the batch error once next returns.
+type BatchInterceptor func(requests [][]interface{}, headers map[string]string, next func(requests [][]interface{}, headers map[string]string) error) error
+
+// Use adds request and batch interceptors to the client. Interceptors run in
+// the order they were added, the first one being the outermost.
+func (c *HttpClient) Use(interceptors ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, interceptor := range interceptors {
+		switch i := interceptor.(type) {
+		case RequestInterceptor:
+			c.requestInterceptors = append(c.requestInterceptors, i)
+		case func(*Call, func(*Call) (map[string]interface{}, error)) (map[string]interface{}, error):
+			c.requestInterceptors = append(c.requestInterceptors, i)
+		case BatchInterceptor:
+			c.batchInterceptors = append(c.batchInterceptors, i)
+		case func([][]interface{}, map[string]string, func([][]interface{}, map[string]string) error) error:
+			c.batchInterceptors = append(c.batchInterceptors, i)
+		default:
+			panic("Interceptors should be request or batch interceptors")
+		}
+	}
+}
+
+func chainRequestInterceptors(interceptors []RequestInterceptor, final func(call *Call) (map[string]interface{}, error)) func(call *Call) (map[string]interface{}, error) {
+	next := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func(call *Call) (map[string]interface{}, error) {
+			return interceptor(call, inner)
+		}
+	}
+	return next
+}
+
+func chainBatchInterceptors(interceptors []BatchInterceptor, final func(requests [][]interface{}, headers map[string]string) error) func(requests [][]interface{}, headers map[string]string) error {
+	next := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func(requests [][]interface{}, headers map[string]string) error {
+			return interceptor(requests, headers, inner)
+		}
+	}
+	return next
+}
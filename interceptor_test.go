@@ -0,0 +1,114 @@
+package blest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterceptors(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter()
+	router.Route("echo", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"body": body, "headers": context["headers"]}, nil
+	})
+
+	var mu sync.Mutex
+	token := "expired"
+	handler := router.HttpHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		valid := r.Header.Get("Authorization") == "Bearer "+token
+		mu.Unlock()
+		if !valid {
+			writeHttpError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := NewHttpClient(server.URL)
+
+	// A batch interceptor adds the token, and refreshes it once when it is
+	// rejected
+	current := "stale"
+	refreshes := 0
+	var order []string
+	client.Use(func(requests [][]interface{}, headers map[string]string, next func([][]interface{}, map[string]string) error) error {
+		headers["Authorization"] = "Bearer " + current
+		err := next(requests, headers)
+		if blestErr, ok := err.(*BlestError); ok && blestErr.StatusCode == 401 {
+			refreshes++
+			mu.Lock()
+			token = "fresh"
+			mu.Unlock()
+			current = "fresh"
+			headers["Authorization"] = "Bearer " + current
+			err = next(requests, headers)
+		}
+		return err
+	})
+
+	// Request interceptors run in order around each call
+	calls := 0
+	failures := 0
+	client.Use(RequestInterceptor(func(call *Call, next func(*Call) (map[string]interface{}, error)) (map[string]interface{}, error) {
+		order = append(order, "outer")
+		if call.Route == "forbidden" {
+			return nil, errors.New("not allowed")
+		}
+		result, err := next(call)
+		calls++
+		if err != nil {
+			failures++
+		}
+		return result, err
+	}), func(call *Call, next func(*Call) (map[string]interface{}, error)) (map[string]interface{}, error) {
+		order = append(order, "inner")
+		call.Headers = map[string]interface{}{"traceId": "abc"}
+		return next(call)
+	})
+
+	result, err := client.Request("echo", map[string]interface{}{"a": 1.0})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"a": 1.0}, result["body"])
+	assert.Equal(t, "abc", result["headers"].(map[string]interface{})["traceId"])
+	assert.Equal(t, 1, refreshes)
+	assert.Equal(t, []string{"outer", "inner"}, order)
+	assert.Equal(t, 1, calls)
+
+	// The refreshed token is kept for later batches, which reach the server
+	// with the client's own headers untouched
+	_, err = client.Request("echo")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, refreshes)
+	assert.Empty(t, client.HttpHeaders)
+
+	// A request interceptor can fail a call before it is sent
+	_, err = client.Request("forbidden")
+	assert.EqualError(t, err, "not allowed")
+	assert.Equal(t, 2, calls)
+
+	// Item errors reach request interceptors on the way out
+	_, err = client.Request("missing")
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, failures)
+
+	// A batch interceptor can fail every item of a batch without sending it
+	blocked := NewHttpClient(server.URL)
+	blocked.Use(BatchInterceptor(func(requests [][]interface{}, headers map[string]string, next func([][]interface{}, map[string]string) error) error {
+		return &BlestError{Message: "Offline", StatusCode: 503, Code: "OFFLINE"}
+	}))
+	_, err = blocked.Request("echo")
+	assert.Equal(t, "OFFLINE", err.(*BlestError).Code)
+
+	assert.Panics(t, func() {
+		client.Use(func() {})
+	})
+}
@@ -0,0 +1,116 @@
+package blest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	defaultMaxBodySize  = 1 << 20
+	defaultMaxBatchSize = 100
+	defaultMaxDepth     = 32
+	// defaultMaxConcurrentBatches bounds the batches a persistent connection
+	// runs at once
+	defaultMaxConcurrentBatches = 16
+)
+
+// requestLimits bounds the size and shape of incoming batches. Options that
+// are not set use the defaults, and a zero value disables the corresponding
+// check.
+type requestLimits struct {
+	maxBodySize          int64
+	maxBatchSize         int
+	maxDepth             int
+	maxStringLength      int
+	maxConcurrentBatches int
+}
+
+func parseRequestLimits(options map[string]interface{}) requestLimits {
+	return requestLimits{
+		maxBodySize:          int64(parseLimitOption(options, "maxBodySize", defaultMaxBodySize)),
+		maxBatchSize:         parseLimitOption(options, "maxBatchSize", defaultMaxBatchSize),
+		maxDepth:             parseLimitOption(options, "maxDepth", defaultMaxDepth),
+		maxStringLength:      parseLimitOption(options, "maxStringLength", 0),
+		maxConcurrentBatches: parseLimitOption(options, "maxConcurrentBatches", defaultMaxConcurrentBatches),
+	}
+}
+
+func parseLimitOption(options map[string]interface{}, key string, defaultValue int) int {
+	if options[key] == nil {
+		return defaultValue
+	}
+	value, ok := options[key].(int)
+	if !ok {
+		panic(fmt.Sprintf("%s should be an integer", key))
+	}
+	if value < 0 {
+		panic(fmt.Sprintf("%s should be zero or a positive integer", key))
+	}
+	return value
+}
+
+// limitBody caps the bytes read from a request body, unless the body size
+// limit is disabled.
+func (l requestLimits) limitBody(w http.ResponseWriter, body io.ReadCloser) io.ReadCloser {
+	if l.maxBodySize <= 0 {
+		return body
+	}
+	return http.MaxBytesReader(w, body, l.maxBodySize)
+}
+
+func (l requestLimits) check(requests [][]interface{}) *BlestError {
+	if l.maxBatchSize > 0 && len(requests) > l.maxBatchSize {
+		return &BlestError{Message: fmt.Sprintf("Batch should contain at most %d items", l.maxBatchSize), StatusCode: 413, Code: "BATCH_TOO_LARGE"}
+	}
+	for _, request := range requests {
+		for i, value := range request {
+			depth := 0
+			if i < 2 {
+				depth = -1
+			}
+			if err := l.checkValue(value, depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l requestLimits) checkValue(value interface{}, depth int) *BlestError {
+	switch v := value.(type) {
+	case string:
+		return l.checkString(v)
+	case map[string]interface{}:
+		depth++
+		if l.maxDepth > 0 && depth > l.maxDepth {
+			return &BlestError{Message: fmt.Sprintf("Request item should be nested at most %d levels deep", l.maxDepth), StatusCode: 400, Code: "MAX_DEPTH_EXCEEDED"}
+		}
+		for key, nested := range v {
+			if err := l.checkString(key); err != nil {
+				return err
+			}
+			if err := l.checkValue(nested, depth); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		depth++
+		if l.maxDepth > 0 && depth > l.maxDepth {
+			return &BlestError{Message: fmt.Sprintf("Request item should be nested at most %d levels deep", l.maxDepth), StatusCode: 400, Code: "MAX_DEPTH_EXCEEDED"}
+		}
+		for _, nested := range v {
+			if err := l.checkValue(nested, depth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l requestLimits) checkString(value string) *BlestError {
+	if l.maxStringLength > 0 && len(value) > l.maxStringLength {
+		return &BlestError{Message: fmt.Sprintf("Strings should be at most %d bytes long", l.maxStringLength), StatusCode: 413, Code: "STRING_TOO_LONG"}
+	}
+	return nil
+}
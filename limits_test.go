@@ -0,0 +1,99 @@
+package blest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLimits(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter(map[string]interface{}{
+		"maxBodySize":     256,
+		"maxBatchSize":    2,
+		"maxDepth":        3,
+		"maxStringLength": 16,
+	})
+	router.Route("basicRoute", func(body map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"hello": "world"}, nil
+	})
+
+	server := httptest.NewServer(NewHttpHandler(router.Handle, router.Options))
+	defer server.Close()
+
+	post := func(payload string) (int, map[string]interface{}) {
+		response, err := http.Post(server.URL, "application/json", strings.NewReader(payload))
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		var errorObject map[string]interface{}
+		json.NewDecoder(response.Body).Decode(&errorObject)
+		return response.StatusCode, errorObject
+	}
+
+	// Within limits
+	status, _ := post(`[["a","basicRoute",{"one":{"two":{"three":true}}}]]`)
+	assert.Equal(t, 200, status)
+
+	// Body too large
+	status, errorObject := post(`[["a","basicRoute",{"value":"` + strings.Repeat("x", 300) + `"}]]`)
+	assert.Equal(t, 413, status)
+	assert.Equal(t, "BODY_TOO_LARGE", errorObject["code"])
+
+	// Batch too large
+	status, errorObject = post(`[["a","basicRoute"],["b","basicRoute"],["c","basicRoute"]]`)
+	assert.Equal(t, 413, status)
+	assert.Equal(t, "BATCH_TOO_LARGE", errorObject["code"])
+
+	// Nested too deep
+	status, errorObject = post(`[["a","basicRoute",{"one":{"two":{"three":{"four":true}}}}]]`)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, "MAX_DEPTH_EXCEEDED", errorObject["code"])
+
+	status, errorObject = post(`[["a","basicRoute",{"one":[[[true]]]}]]`)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, "MAX_DEPTH_EXCEEDED", errorObject["code"])
+
+	// String too long
+	status, errorObject = post(`[["a","basicRoute",{"value":"` + strings.Repeat("x", 17) + `"}]]`)
+	assert.Equal(t, 413, status)
+	assert.Equal(t, "STRING_TOO_LONG", errorObject["code"])
+
+	// Limits also apply when the router is used directly
+	_, reqErr := router.Handle([][]interface{}{{"a", "basicRoute"}, {"b", "basicRoute"}, {"c", "basicRoute"}}, nil)
+	assert.Equal(t, 413, reqErr["statusCode"])
+	assert.Equal(t, "BATCH_TOO_LARGE", reqErr["code"])
+
+	// A zero value disables a check, while unset options use the defaults
+	unlimited := NewRouter(map[string]interface{}{"maxBodySize": 0, "maxBatchSize": 0})
+	unlimited.Route("basicRoute", func(body map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"hello": "world"}, nil
+	})
+	assert.Equal(t, defaultMaxDepth, unlimited.limits.maxDepth)
+	requests := make([][]interface{}, defaultMaxBatchSize+1)
+	for i := range requests {
+		requests[i] = []interface{}{strconv.Itoa(i), "basicRoute"}
+	}
+	result, reqErr := unlimited.Handle(requests, nil)
+	assert.Nil(t, reqErr)
+	assert.Len(t, result, defaultMaxBatchSize+1)
+
+	unlimitedServer := httptest.NewServer(NewHttpHandler(unlimited.Handle, unlimited.Options))
+	defer unlimitedServer.Close()
+	response, err := http.Post(unlimitedServer.URL, "application/json", strings.NewReader(`[["a","basicRoute",{"value":"`+strings.Repeat("x", defaultMaxBodySize)+`"}]]`))
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, 200, response.StatusCode)
+
+	assert.Panics(t, func() {
+		NewRouter(map[string]interface{}{"maxBatchSize": "ten"})
+	})
+	assert.Panics(t, func() {
+		NewRouter(map[string]interface{}{"maxDepth": -1})
+	})
+}
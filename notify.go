@@ -0,0 +1,74 @@
+package blest
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Notify sends a call whose result the caller does not need. It shares a
+// batch with other calls and returns once the server has accepted the
+// batch, with the batch error if it was rejected, or once the request
+// timeout has passed. The server runs the call without waiting for it to
+// finish and never reports its result.
+func (c *HttpClient) Notify(route string, args ...interface{}) error {
+	body, headers, err := parseRequestArgs(route, args)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	interceptors := c.requestInterceptors
+	c.mu.Unlock()
+	_, err = chainRequestInterceptors(interceptors, c.enqueueNotification)(&Call{Route: route, Body: body, Headers: headers})
+	return err
+}
+
+func (c *HttpClient) enqueueNotification(call *Call) (map[string]interface{}, error) {
+	if call.Route == "" {
+		return nil, errors.New("route is required")
+	}
+
+	// The call is queued under a placeholder ID, which Process swaps for the
+	// empty ID that marks notifications
+	id := uuid.New().String()
+	ch := make(chan error, 1)
+	c.mu.Lock()
+	if c.notifications == nil {
+		c.notifications = make(map[string]chan error)
+	}
+	c.notifications[id] = ch
+	c.Queue = append(c.Queue, []interface{}{id, call.Route, call.Body, call.Headers})
+	if c.Timeout == nil {
+		c.Timeout = time.AfterFunc(1*time.Millisecond, c.Process)
+	}
+	c.mu.Unlock()
+	select {
+	case err := <-ch:
+		return nil, err
+	case <-time.After(c.requestTimeout):
+		return nil, errors.New("Request timed out")
+	}
+}
+
+// takeNotifications replaces the placeholder IDs of the notifications in a
+// batch, and returns the channels waiting on the batch. It must be called
+// with the lock held.
+func (c *HttpClient) takeNotifications(requests [][]interface{}) ([][]interface{}, []chan error) {
+	if len(c.notifications) == 0 {
+		return requests, nil
+	}
+	var waiting []chan error
+	replaced := make([][]interface{}, len(requests))
+	for i, request := range requests {
+		replaced[i] = request
+		id, _ := request[0].(string)
+		if ch, ok := c.notifications[id]; ok {
+			delete(c.notifications, id)
+			waiting = append(waiting, ch)
+			replaced[i] = append([]interface{}{""}, request[1:]...)
+		}
+	}
+	return replaced, waiting
+}
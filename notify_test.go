@@ -0,0 +1,114 @@
+package blest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifications(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	received := make(chan interface{}, 10)
+	router := NewRouter()
+	router.Route("log", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		<-release
+		received <- body["message"]
+		return map[string]interface{}{"logged": true}, nil
+	})
+	router.Route("ping", func() (interface{}, error) {
+		return map[string]interface{}{"pong": true}, nil
+	})
+
+	// Notifications run without a result, and the batch does not wait for
+	// them
+	result, reqErr := router.Handle([][]interface{}{
+		{"", "log", map[string]interface{}{"message": "a"}},
+		{"1", "ping"},
+		{"", "log", map[string]interface{}{"message": "b"}},
+	}, map[string]interface{}{})
+	assert.Nil(t, reqErr)
+	assert.Len(t, result, 1)
+	assert.Equal(t, "1", result[0][0])
+	close(release)
+	messages := []interface{}{<-received, <-received}
+	assert.ElementsMatch(t, []interface{}{"a", "b"}, messages)
+
+	result, reqErr = router.Handle([][]interface{}{{"", "ping"}}, map[string]interface{}{})
+	assert.Nil(t, reqErr)
+	assert.Empty(t, result)
+	_, reqErr = router.Handle([][]interface{}{{1, "ping"}}, map[string]interface{}{})
+	assert.Equal(t, "MISSING_ID", reqErr["code"])
+
+	// The client shares a batch between notifications and requests
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+	client := NewHttpClient(server.URL)
+	var mu sync.Mutex
+	var batches [][]interface{}
+	client.Use(func(requests [][]interface{}, headers map[string]string, next func([][]interface{}, map[string]string) error) error {
+		mu.Lock()
+		ids := make([]interface{}, len(requests))
+		for i, request := range requests {
+			ids[i] = request[0]
+		}
+		batches = append(batches, ids)
+		mu.Unlock()
+		return next(requests, headers)
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.Nil(t, client.Notify("log", map[string]interface{}{"message": "c"}))
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := client.Request("ping")
+		assert.Nil(t, err)
+	}()
+	wg.Wait()
+	select {
+	case message := <-received:
+		assert.Equal(t, "c", message)
+	case <-time.After(time.Second):
+		t.Fatal("notification did not run")
+	}
+	mu.Lock()
+	assert.Len(t, batches, 1)
+	assert.Len(t, batches[0], 2)
+	assert.Contains(t, batches[0], "")
+	mu.Unlock()
+
+	// Request interceptors see notifications, and can fail them early
+	var intercepted []string
+	client.Use(func(call *Call, next func(*Call) (map[string]interface{}, error)) (map[string]interface{}, error) {
+		if call.Route == "denied" {
+			return nil, NewBlestError("Forbidden", 403)
+		}
+		result, err := next(call)
+		mu.Lock()
+		intercepted = append(intercepted, call.Route)
+		mu.Unlock()
+		assert.Nil(t, result)
+		return result, err
+	})
+	assert.Nil(t, client.Notify("log", map[string]interface{}{"message": "d"}))
+	assert.Equal(t, "d", <-received)
+	assert.Equal(t, 403, client.Notify("denied").(*BlestError).StatusCode)
+	mu.Lock()
+	assert.Equal(t, []string{"log"}, intercepted)
+	mu.Unlock()
+
+	// A rejected batch fails the notification
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	assert.NotNil(t, NewHttpClient(closed.URL).Notify("log"))
+	assert.NotNil(t, client.Notify(""))
+}
@@ -0,0 +1,100 @@
+package blest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// ToInt64 converts a decoded number to an int64 without losing precision.
+// It accepts json.Number, every integer type, *big.Int and integral floats.
+func ToInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return i, err == nil
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), uint64(n) <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case *big.Int:
+		return n.Int64(), n.IsInt64()
+	case float32:
+		return int64(n), float32(int64(n)) == n
+	case float64:
+		return int64(n), n >= math.MinInt64 && n < math.MaxInt64 && float64(int64(n)) == n
+	}
+	return 0, false
+}
+
+func intValue(v interface{}) (int, bool) {
+	i, ok := ToInt64(v)
+	return int(i), ok
+}
+
+// GetInt64 reads an integer field from a request body.
+func GetInt64(body map[string]interface{}, key string) (int64, error) {
+	value, exists := body[key]
+	if !exists || value == nil {
+		return 0, NewBlestError(fmt.Sprintf("%s is required", key), 400, "INVALID_BODY")
+	}
+	i, ok := ToInt64(value)
+	if !ok {
+		return 0, NewBlestError(fmt.Sprintf("%s should be an integer", key), 400, "INVALID_BODY")
+	}
+	return i, nil
+}
+
+// GetInt reads an integer field from a request body.
+func GetInt(body map[string]interface{}, key string) (int, error) {
+	i, err := GetInt64(body, key)
+	if err != nil {
+		return 0, err
+	}
+	if int64(int(i)) != i {
+		return 0, NewBlestError(fmt.Sprintf("%s is out of range", key), 400, "INVALID_BODY")
+	}
+	return int(i), nil
+}
+
+// DecodeBody decodes a request body into a struct. Integer fields are exact
+// when the body was decoded with json.Number or a binary codec.
+func DecodeBody(body map[string]interface{}, target interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, target); err != nil {
+		return NewBlestError(fmt.Sprintf("Invalid request body: %s", err.Error()), 400, "INVALID_BODY")
+	}
+	return nil
+}
+
+// Typed adapts a handler that takes its body as a struct into a regular
+// route handler.
+func Typed[T any](handler func(body T, context map[string]interface{}) (interface{}, error)) func(map[string]interface{}, map[string]interface{}) (interface{}, error) {
+	return func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		var typed T
+		if err := DecodeBody(body, &typed); err != nil {
+			return nil, err
+		}
+		return handler(typed, context)
+	}
+}
@@ -0,0 +1,81 @@
+package blest
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNumbers(t *testing.T) {
+	t.Parallel()
+
+	const bigID = int64(9007199254740993)
+
+	type order struct {
+		ID       int64 `json:"id"`
+		Quantity int   `json:"quantity"`
+	}
+
+	router := NewRouter(map[string]interface{}{"useNumber": true})
+	router.Route("idRoute", func(body map[string]interface{}) (interface{}, error) {
+		id, err := GetInt64(body, "id")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"id": id, "next": id + 1}, nil
+	})
+	router.Route("orderRoute", Typed(func(body order, context map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"id": body.ID, "quantity": body.Quantity}, nil
+	}))
+
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+
+	// Integers beyond 2^53 survive the round trip exactly
+	client := NewHttpClient(server.URL, map[string]interface{}{"useNumber": true})
+	result, err := client.Request("idRoute", map[string]interface{}{"id": bigID})
+	assert.Nil(t, err)
+	assert.Equal(t, json.Number("9007199254740993"), result["id"])
+	next, err := GetInt64(result, "next")
+	assert.Nil(t, err)
+	assert.Equal(t, bigID+1, next)
+
+	result, err = client.Request("orderRoute", map[string]interface{}{"id": bigID, "quantity": 3})
+	assert.Nil(t, err)
+	assert.Equal(t, json.Number("9007199254740993"), result["id"])
+	assert.Equal(t, json.Number("3"), result["quantity"])
+
+	// Decoding failures are reported as bad requests
+	_, err = client.Request("idRoute", map[string]interface{}{"id": 1.5})
+	blestErr, ok := err.(*BlestError)
+	assert.True(t, ok)
+	assert.Equal(t, 400, blestErr.StatusCode)
+	assert.Equal(t, "INVALID_BODY", blestErr.Code)
+
+	_, err = client.Request("orderRoute", map[string]interface{}{"id": "abc"})
+	blestErr, ok = err.(*BlestError)
+	assert.True(t, ok)
+	assert.Equal(t, 400, blestErr.StatusCode)
+	assert.Equal(t, "INVALID_BODY", blestErr.Code)
+
+	// Without useNumber the client decodes float64 as before
+	client = NewHttpClient(server.URL)
+	result, err = client.Request("idRoute", map[string]interface{}{"id": 7})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(7), result["id"])
+
+	for _, value := range []interface{}{json.Number("42"), 42, int32(42), uint64(42), float64(42), big.NewInt(42)} {
+		i, ok := ToInt64(value)
+		assert.True(t, ok)
+		assert.Equal(t, int64(42), i)
+	}
+	for _, value := range []interface{}{json.Number("4.2"), 4.2, uint64(1 << 63), "42", nil} {
+		_, ok := ToInt64(value)
+		assert.False(t, ok)
+	}
+	_, err = GetInt(map[string]interface{}{}, "missing")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,323 @@
+package blest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errNoOfflineQueue = errors.New("offline queue is not configured")
+
+// offlineQueue keeps fire-and-forget calls in a local directory, one file per
+// call, until they are delivered. Files are named after the time they were
+// queued so that calls are sent in order.
+type offlineQueue struct {
+	dir      string
+	interval time.Duration
+	mu       sync.Mutex
+	flushing sync.Mutex
+	timer    *time.Timer
+	due      time.Time
+
+	// serverBatchSize is the largest batch the server accepts, 0 until the
+	// server has described its limits and -1 if it has none. It is guarded
+	// by flushing.
+	serverBatchSize int
+}
+
+type offlineEntry struct {
+	name    string
+	request []interface{}
+}
+
+func parseOfflineQueue(options map[string]interface{}) *offlineQueue {
+	if options["offlineQueue"] == nil {
+		return nil
+	}
+	dir, ok := options["offlineQueue"].(string)
+	if !ok || dir == "" {
+		panic("Offline queue should be a directory path")
+	}
+	interval := 5 * time.Second
+	if options["offlineRetryInterval"] != nil {
+		i, ok := options["offlineRetryInterval"].(int)
+		if !ok || i <= 0 {
+			panic("Offline retry interval should be a positive integer")
+		}
+		interval = time.Duration(i) * time.Millisecond
+	}
+	return &offlineQueue{dir: dir, interval: interval}
+}
+
+// push writes the call to a temporary file and renames it into place, so a
+// crash never leaves a partial call in the queue. The directory is created
+// with the first call.
+func (q *offlineQueue) push(request []interface{}) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), request[0])
+	temp, err := os.CreateTemp(q.dir, ".pending-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), filepath.Join(q.dir, name))
+}
+
+// load reads every queued call in order. Files that cannot be read as a call
+// are dropped, and a directory that does not exist yet holds no calls.
+func (q *offlineQueue) load() ([]offlineEntry, error) {
+	files, err := os.ReadDir(q.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	entries := make([]offlineEntry, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(q.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var request []interface{}
+		if err := json.Unmarshal(data, &request); err != nil || len(request) < 4 {
+			log.Println("Dropping unreadable offline call", name)
+			q.remove(name)
+			continue
+		}
+		if _, ok := request[0].(string); !ok {
+			log.Println("Dropping unreadable offline call", name)
+			q.remove(name)
+			continue
+		}
+		entries = append(entries, offlineEntry{name: name, request: request})
+	}
+	return entries, nil
+}
+
+func (q *offlineQueue) remove(name string) {
+	if err := os.Remove(filepath.Join(q.dir, name)); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+}
+
+// schedule flushes the queue after the delay, unless a flush is already
+// scheduled to happen sooner.
+func (q *offlineQueue) schedule(delay time.Duration, flush func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	due := time.Now().Add(delay)
+	if q.timer != nil {
+		if !q.due.After(due) {
+			return
+		}
+		q.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		if q.timer == timer {
+			q.timer = nil
+		}
+		q.mu.Unlock()
+		flush()
+	})
+	q.timer, q.due = timer, due
+}
+
+// offlineRetryable reports whether a call that failed with the error should
+// stay in the queue. Errors without a status code, and those that a retry
+// may fix, keep the call. So do idempotency conflicts, which mean an earlier
+// delivery is still running and may yet fail.
+func offlineRetryable(errorValue interface{}) bool {
+	errorObject, ok := errorValue.(map[string]interface{})
+	if !ok {
+		return true
+	}
+	statusCode, ok := intValue(errorObject["statusCode"])
+	if !ok || (statusCode == 409 && errorObject["code"] == "IDEMPOTENCY_CONFLICT") {
+		return true
+	}
+	for _, code := range defaultRetryStatusCodes {
+		if statusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// offlineBatchRetryable is offlineRetryable for the error of a whole batch.
+func offlineBatchRetryable(err error) bool {
+	blestErr, ok := err.(*BlestError)
+	if !ok {
+		return true
+	}
+	return offlineRetryable(map[string]interface{}{"statusCode": blestErr.StatusCode, "code": blestErr.Code})
+}
+
+// Enqueue persists a fire-and-forget call in the offline queue and returns
+// once it is on disk. Calls are sent in the background in the order they
+// were queued, and are retried until the server answers them, so every call
+// carries an idempotency key to make redelivery safe. Calls the server
+// rejects with an error that a retry cannot fix are logged and dropped.
+func (c *HttpClient) Enqueue(route string, args ...interface{}) error {
+	if c.offline == nil {
+		return errNoOfflineQueue
+	}
+	body, headers, err := parseRequestArgs(route, args)
+	if err != nil {
+		return err
+	}
+	withKey := make(map[string]interface{}, len(headers)+1)
+	for key, value := range headers {
+		withKey[key] = value
+	}
+	id := uuid.New().String()
+	if idempotencyKey(withKey) == "" {
+		withKey[idempotencyKeyHeader] = id
+	}
+	if err := c.offline.push([]interface{}{id, route, body, withKey}); err != nil {
+		return err
+	}
+	c.offline.schedule(0, c.flushInBackground)
+	return nil
+}
+
+// Flush tries to deliver every call in the offline queue, in batches no
+// larger than the server accepts, and returns the error that stopped it, if
+// any. When the server rejects a batch as a whole with an error that a retry
+// cannot fix, its calls are sent one at a time so that only the ones the
+// server cannot take are dropped.
+func (c *HttpClient) Flush() error {
+	if c.offline == nil {
+		return errNoOfflineQueue
+	}
+	c.offline.flushing.Lock()
+	defer c.offline.flushing.Unlock()
+	entries, err := c.offline.load()
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	size := c.offlineBatchSize()
+	for start := 0; start < len(entries); start += size {
+		unanswered, err := c.flushBatch(entries[start:min(len(entries), start+size)])
+		if err != nil && offlineBatchRetryable(err) {
+			return err
+		} else if err == nil {
+			continue
+		}
+		for _, entry := range unanswered {
+			if len(unanswered) > 1 {
+				_, err = c.flushBatch([]offlineEntry{entry})
+				if err == nil {
+					continue
+				} else if offlineBatchRetryable(err) {
+					return err
+				}
+			}
+			log.Println("Dropping offline call", entry.name, err)
+			c.offline.remove(entry.name)
+		}
+	}
+	return nil
+}
+
+// flushBatch sends queued calls as one batch and removes the ones the server
+// answers, unless their error is retryable. It returns the calls left
+// unanswered along with the batch error.
+func (c *HttpClient) flushBatch(batch []offlineEntry) ([]offlineEntry, error) {
+	names := make(map[string]string, len(batch))
+	requests := make([][]interface{}, len(batch))
+	for i, entry := range batch {
+		names[entry.request[0].(string)] = entry.name
+		requests[i] = entry.request
+	}
+	answered := make(map[string]bool, len(batch))
+	err := c.send(requests, func(r []interface{}) {
+		name, ok := names[r[0].(string)]
+		if !ok {
+			return
+		}
+		answered[name] = true
+		if r[3] != nil && offlineRetryable(r[3]) {
+			return
+		}
+		if r[3] != nil {
+			log.Println("Dropping offline call", name, r[3])
+		}
+		c.offline.remove(name)
+	})
+	if err == nil {
+		return nil, nil
+	}
+	var unanswered []offlineEntry
+	for _, entry := range batch {
+		if !answered[entry.name] {
+			unanswered = append(unanswered, entry)
+		}
+	}
+	return unanswered, err
+}
+
+// offlineBatchSize is the client's batch size, capped at the largest batch
+// the server accepts. The server is asked for its limits until it answers.
+func (c *HttpClient) offlineBatchSize() int {
+	if c.offline.serverBatchSize == 0 {
+		capabilities, err := c.Capabilities()
+		if blestErr, ok := err.(*BlestError); ok && blestErr.Code == "CAPABILITIES_UNSUPPORTED" {
+			c.offline.serverBatchSize = -1
+		} else if err == nil {
+			if size, ok := intValue(capabilities["maxBatchSize"]); ok && size > 0 {
+				c.offline.serverBatchSize = size
+			} else {
+				c.offline.serverBatchSize = -1
+			}
+		}
+	}
+	if c.offline.serverBatchSize > 0 {
+		return min(c.MaxBatchSize, c.offline.serverBatchSize)
+	}
+	return c.MaxBatchSize
+}
+
+// flushInBackground flushes the queue and tries again later while calls
+// remain.
+func (c *HttpClient) flushInBackground() {
+	c.Flush()
+	entries, err := c.offline.load()
+	if err != nil || len(entries) > 0 {
+		c.offline.schedule(c.offline.interval, c.flushInBackground)
+	}
+}
@@ -0,0 +1,176 @@
+package blest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfflineQueue(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var received []float64
+	keys := make(map[string]bool)
+	router := NewRouter()
+	router.Route("event", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, body["n"].(float64))
+		key, _ := context["headers"].(map[string]interface{})[idempotencyKeyHeader].(string)
+		keys[key] = true
+		return nil, nil
+	})
+	var unavailable atomic.Int32
+	router.Route("busy", func() (interface{}, error) {
+		if unavailable.Add(-1) >= 0 {
+			return nil, NewBlestError("Busy", 503)
+		}
+		return nil, nil
+	})
+
+	var offline atomic.Bool
+	handler := router.HttpHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if offline.Load() {
+			writeHttpError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "Service Unavailable")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	pending := func(dir string) int {
+		files, _ := os.ReadDir(dir)
+		return len(files)
+	}
+
+	// Calls made while the server is unreachable are kept on disk, and sent
+	// in order once it is back
+	dir := t.TempDir()
+	offline.Store(true)
+	client := NewHttpClient(server.URL, map[string]interface{}{"offlineQueue": dir, "offlineRetryInterval": 20})
+	var sent []interface{}
+	client.Use(func(requests [][]interface{}, headers map[string]string, next func([][]interface{}, map[string]string) error) error {
+		err := next(requests, headers)
+		if err == nil {
+			mu.Lock()
+			for _, request := range requests {
+				if request[1] == "event" {
+					sent = append(sent, request[2].(map[string]interface{})["n"])
+				}
+			}
+			mu.Unlock()
+		}
+		return err
+	})
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, client.Enqueue("event", map[string]interface{}{"n": float64(i)}))
+	}
+	assert.Equal(t, 3, pending(dir))
+	assert.NotNil(t, client.Flush())
+
+	offline.Store(false)
+	assert.Eventually(t, func() bool { return pending(dir) == 0 }, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []interface{}{1.0, 2.0, 3.0}, sent)
+	assert.Len(t, received, 3)
+	assert.Len(t, keys, 3)
+	assert.False(t, keys[""])
+	mu.Unlock()
+
+	// A new client delivers the calls an earlier one left behind
+	dir = t.TempDir()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	lost := NewHttpClient(closed.URL, map[string]interface{}{"offlineQueue": dir, "offlineRetryInterval": 1000})
+	assert.Nil(t, lost.Enqueue("event", map[string]interface{}{"n": 4.0}, map[string]interface{}{idempotencyKeyHeader: "mine"}))
+	assert.Eventually(t, func() bool { return pending(dir) == 1 }, time.Second, 10*time.Millisecond)
+	NewHttpClient(server.URL, map[string]interface{}{"offlineQueue": dir})
+	assert.Eventually(t, func() bool { return pending(dir) == 0 }, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, 4.0, received[3])
+	assert.True(t, keys["mine"])
+	mu.Unlock()
+
+	// Items that fail with a retryable error are kept, others are dropped
+	dir = t.TempDir()
+	unavailable.Store(1000)
+	client = NewHttpClient(server.URL, map[string]interface{}{"offlineQueue": dir, "offlineRetryInterval": 1000})
+	client.Enqueue("busy")
+	client.Enqueue("missing")
+	assert.Eventually(t, func() bool { return pending(dir) == 1 }, time.Second, 10*time.Millisecond)
+	unavailable.Store(0)
+	assert.Nil(t, client.Flush())
+	assert.Equal(t, 0, pending(dir))
+
+	// Conflicts with a delivery still in progress keep the call, since that
+	// delivery may fail
+	assert.True(t, offlineRetryable(map[string]interface{}{"statusCode": 409.0, "code": "IDEMPOTENCY_CONFLICT"}))
+	assert.False(t, offlineRetryable(map[string]interface{}{"statusCode": 409.0, "code": "CONFLICT"}))
+	assert.False(t, offlineRetryable(map[string]interface{}{"statusCode": 422.0, "code": "IDEMPOTENCY_KEY_REUSED"}))
+
+	// Calls are sent in batches the server accepts, and a call that gets its
+	// batch rejected as a whole is dropped without holding up the others
+	limited := NewRouter(map[string]interface{}{"maxBatchSize": 2, "maxStringLength": 64})
+	var limitedMu sync.Mutex
+	var batchSizes []int
+	var delivered []interface{}
+	limited.Route("event", func(body map[string]interface{}) (interface{}, error) {
+		limitedMu.Lock()
+		defer limitedMu.Unlock()
+		delivered = append(delivered, body["n"])
+		return nil, nil
+	})
+	limitedServer := httptest.NewServer(limited.HttpHandler())
+	defer limitedServer.Close()
+	dir = t.TempDir()
+	client = NewHttpClient(limitedServer.URL, map[string]interface{}{"offlineQueue": dir, "offlineRetryInterval": 1000})
+	client.Use(func(requests [][]interface{}, headers map[string]string, next func([][]interface{}, map[string]string) error) error {
+		limitedMu.Lock()
+		batchSizes = append(batchSizes, len(requests))
+		limitedMu.Unlock()
+		return next(requests, headers)
+	})
+	client.offline.flushing.Lock()
+	for i := 1; i <= 5; i++ {
+		body := map[string]interface{}{"n": float64(i)}
+		if i == 2 {
+			body["text"] = strings.Repeat("x", 100)
+		}
+		assert.Nil(t, client.Enqueue("event", body))
+	}
+	client.offline.flushing.Unlock()
+	assert.Eventually(t, func() bool { return pending(dir) == 0 }, time.Second, 10*time.Millisecond)
+	limitedMu.Lock()
+	assert.Equal(t, []interface{}{1.0, 3.0, 4.0, 5.0}, delivered)
+	for _, size := range batchSizes {
+		assert.LessOrEqual(t, size, 2)
+	}
+	limitedMu.Unlock()
+
+	// The directory is created with the first call, and failing to create it
+	// is reported by Enqueue
+	dir = filepath.Join(t.TempDir(), "nested", "queue")
+	client = NewHttpClient(server.URL, map[string]interface{}{"offlineQueue": dir, "offlineRetryInterval": 1000})
+	assert.Nil(t, client.Flush())
+	assert.Nil(t, client.Enqueue("event", map[string]interface{}{"n": 5.0}))
+	assert.Eventually(t, func() bool { return pending(dir) == 0 }, time.Second, 10*time.Millisecond)
+	file := filepath.Join(t.TempDir(), "file")
+	assert.Nil(t, os.WriteFile(file, nil, 0600))
+	client = NewHttpClient(server.URL, map[string]interface{}{"offlineQueue": filepath.Join(file, "queue")})
+	assert.NotNil(t, client.Enqueue("event"))
+
+	assert.Equal(t, errNoOfflineQueue, NewHttpClient(server.URL).Enqueue("event"))
+	assert.Panics(t, func() {
+		NewHttpClient(server.URL, map[string]interface{}{"offlineQueue": dir, "offlineRetryInterval": 0})
+	})
+}
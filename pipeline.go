@@ -0,0 +1,174 @@
+package blest
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// pipelineConn is a connection that carries one response for every batch
+// written to it, in the order the batches were written.
+type pipelineConn interface {
+	write(payload []byte) error
+	read() ([]byte, error)
+	Close() error
+}
+
+// pipeline sends batches over a connection that is opened on first use and
+// again after it fails. Since responses arrive in order, many batches can be
+// in flight on the connection at once.
+type pipeline struct {
+	open    func() (pipelineConn, error)
+	codec   Codec
+	mu      sync.Mutex
+	conn    pipelineConn
+	pending []chan pipelineResponse
+	closed  bool
+}
+
+type pipelineResponse struct {
+	payload []byte
+	err     error
+}
+
+func (p *pipeline) send(requests [][]interface{}, respond func([]interface{})) error {
+	payload, err := p.codec.Marshal(requests)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	ch := make(chan pipelineResponse, 1)
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errors.New("transport is closed")
+	}
+	if p.conn == nil {
+		conn, err := p.open()
+		if err != nil {
+			p.mu.Unlock()
+			return fmt.Errorf("failed to connect: %w", err)
+		}
+		p.conn = conn
+		go p.readLoop(conn)
+	}
+	p.pending = append(p.pending, ch)
+	if err := p.conn.write(payload); err != nil {
+		// The read loop fails every pending batch once the connection closes
+		p.conn.Close()
+	}
+	p.mu.Unlock()
+
+	response := <-ch
+	if response.err != nil {
+		return response.err
+	}
+
+	var result interface{}
+	if err := p.codec.Unmarshal(response.payload, &result); err != nil {
+		return fmt.Errorf("failed to unmarshal response body: %w", err)
+	}
+	switch r := result.(type) {
+	case []interface{}:
+		for _, item := range r {
+			if tuple, ok := item.([]interface{}); ok {
+				respond(tuple)
+			}
+		}
+	case map[string]interface{}:
+		return blestErrorFromMap(r, 500)
+	}
+	return nil
+}
+
+func (p *pipeline) readLoop(conn pipelineConn) {
+	for {
+		payload, err := conn.read()
+		p.mu.Lock()
+		if err != nil {
+			conn.Close()
+			if p.conn == conn {
+				p.conn = nil
+			}
+			pending := p.pending
+			p.pending = nil
+			p.mu.Unlock()
+			for _, ch := range pending {
+				ch <- pipelineResponse{err: fmt.Errorf("connection failed: %w", err)}
+			}
+			return
+		}
+		if len(p.pending) == 0 {
+			p.mu.Unlock()
+			continue
+		}
+		ch := p.pending[0]
+		p.pending = p.pending[1:]
+		p.mu.Unlock()
+		ch <- pipelineResponse{payload: payload}
+	}
+}
+
+func (p *pipeline) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.Close()
+}
+
+// serveOrdered handles every payload returned by next concurrently, and
+// writes one response per payload in the order they were read. A
+// *BlestError from next is written as the final response before returning.
+func (r *Router) serveOrdered(codec Codec, context map[string]interface{}, next func() ([]byte, error), write func([]byte) error) error {
+	var writeMu sync.Mutex
+	var writeErr error
+	respond := func(v interface{}) {
+		payload, err := codec.Marshal(v)
+		if err != nil {
+			log.Println(err)
+			_, v = handleError(500, "INTERNAL_SERVER_ERROR", err.Error())
+			payload, _ = codec.Marshal(v)
+		}
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if writeErr == nil {
+			writeErr = write(payload)
+		}
+	}
+
+	previous := make(chan struct{})
+	close(previous)
+	for {
+		payload, err := next()
+		if err != nil {
+			<-previous
+			if blestErr, ok := err.(*BlestError); ok {
+				_, reqErr := handleError(blestErr.StatusCode, blestErr.Code, blestErr.Message)
+				respond(reqErr)
+				return nil
+			}
+			return err
+		}
+
+		done := make(chan struct{})
+		go func(payload []byte, previous <-chan struct{}, done chan<- struct{}) {
+			defer close(done)
+			var response interface{}
+			var data [][]interface{}
+			if err := codec.Unmarshal(payload, &data); err != nil {
+				_, response = handleError(400, "INVALID_JSON", "Failed to parse request body")
+			} else if result, reqErr := r.Handle(data, context); reqErr != nil {
+				response = reqErr
+			} else {
+				response = result
+			}
+			<-previous
+			respond(response)
+		}(payload, previous, done)
+		previous = done
+	}
+}
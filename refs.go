@@ -0,0 +1,250 @@
+package blest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// refKey marks a placeholder in a request body, {"$ref": "<id>.<path>"},
+// which is replaced by the value at path in the result of the earlier item
+// with that ID, or by the whole result when there is no path.
+const refKey = "$ref"
+
+// Ref returns a placeholder for the value at path in the result of a call,
+// for use in the body of a later call in the same batch. An empty path
+// stands for the whole result.
+func Ref(id string, path string) map[string]interface{} {
+	if path == "" {
+		return map[string]interface{}{refKey: id}
+	}
+	return map[string]interface{}{refKey: id + "." + path}
+}
+
+type itemOutcome struct {
+	once   sync.Once
+	done   chan struct{}
+	result interface{}
+	failed bool
+}
+
+// dependencyGraph holds the items each item refers to. Items wait for the
+// items they depend on, and fail when one of them has failed.
+type dependencyGraph struct {
+	ids      []string
+	deps     [][]int
+	outcomes []*itemOutcome
+}
+
+func refValue(value interface{}) (string, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(object) != 1 {
+		return "", false
+	}
+	ref, ok := object[refKey].(string)
+	return ref, ok
+}
+
+func collectRefs(value interface{}, refs []string) []string {
+	if ref, ok := refValue(value); ok {
+		return append(refs, ref)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, item := range v {
+			refs = collectRefs(item, refs)
+		}
+	case []interface{}:
+		for _, item := range v {
+			refs = collectRefs(item, refs)
+		}
+	}
+	return refs
+}
+
+// splitRef finds the item a reference points to, preferring the longest
+// matching ID so that IDs may contain dots, and returns the rest as a path.
+func splitRef(ref string, indexes map[string]int) (int, []string, bool) {
+	best := ""
+	found := false
+	for id := range indexes {
+		if (ref == id || strings.HasPrefix(ref, id+".")) && (!found || len(id) > len(best)) {
+			best, found = id, true
+		}
+	}
+	if !found {
+		return 0, nil, false
+	}
+	var path []string
+	if rest := strings.TrimPrefix(ref, best); rest != "" {
+		path = strings.Split(rest[1:], ".")
+	}
+	return indexes[best], path, true
+}
+
+// newDependencyGraph returns nil when no item refers to another, and a batch
+// error when a reference points to the item itself or a later one. Values
+// that look like references but do not start with the ID of an item in the
+// batch, such as JSON Schema references, are left as they are.
+func newDependencyGraph(prepared []preparedRequest) (*dependencyGraph, map[string]interface{}) {
+	ids := make(map[string]int, len(prepared))
+	for i, p := range prepared {
+		if !p.notification {
+			ids[p.request.ID] = i
+		}
+	}
+	var graph *dependencyGraph
+	indexes := make(map[string]int, len(prepared))
+	for i, p := range prepared {
+		for _, ref := range collectRefs(p.request.Body, nil) {
+			index, _, ok := splitRef(ref, indexes)
+			if !ok {
+				if _, _, inBatch := splitRef(ref, ids); inBatch {
+					_, reqErr := handleError(400, "INVALID_REFERENCE", fmt.Sprintf("Reference %q should point to an earlier item in the batch", ref))
+					return nil, reqErr
+				}
+				continue
+			}
+			if graph == nil {
+				graph = &dependencyGraph{
+					ids:  make([]string, len(prepared)),
+					deps: make([][]int, len(prepared)),
+				}
+			}
+			graph.deps[i] = append(graph.deps[i], index)
+		}
+		if !p.notification {
+			indexes[p.request.ID] = i
+		}
+	}
+	if graph == nil {
+		return nil, nil
+	}
+	graph.outcomes = make([]*itemOutcome, len(prepared))
+	for i, p := range prepared {
+		graph.ids[i] = p.request.ID
+		graph.outcomes[i] = &itemOutcome{done: make(chan struct{})}
+	}
+	return graph, nil
+}
+
+func (g *dependencyGraph) complete(index int, result [4]interface{}) {
+	outcome := g.outcomes[index]
+	outcome.once.Do(func() {
+		outcome.result, outcome.failed = result[2], result[3] != nil
+		close(outcome.done)
+	})
+}
+
+// record wraps emit so that the first result of an item is kept for the
+// items that depend on it.
+func (g *dependencyGraph) record(index int, emit func([4]interface{})) func([4]interface{}) {
+	return func(result [4]interface{}) {
+		g.complete(index, result)
+		emit(result)
+	}
+}
+
+// await waits for the items an item depends on and replaces its references
+// with their results. When a dependency failed or a reference cannot be
+// resolved, the item fails without running and await returns false.
+func (g *dependencyGraph) await(index int, p preparedRequest, emit func([4]interface{})) (preparedRequest, bool) {
+	if len(g.deps[index]) == 0 {
+		return p, true
+	}
+	id, route := p.request.ID, p.request.Route
+	fail := func(errorObject map[string]interface{}) (preparedRequest, bool) {
+		result := [4]interface{}{id, route, nil, errorObject}
+		g.complete(index, result)
+		emit(result)
+		return p, false
+	}
+	for _, dep := range g.deps[index] {
+		<-g.outcomes[dep].done
+		if g.outcomes[dep].failed {
+			return fail(map[string]interface{}{"message": fmt.Sprintf("Item %q failed", g.ids[dep]), "statusCode": 424, "code": "DEPENDENCY_FAILED"})
+		}
+	}
+	indexes := make(map[string]int, len(g.deps[index]))
+	for _, dep := range g.deps[index] {
+		indexes[g.ids[dep]] = dep
+	}
+	body, err := g.resolve(p.request.Body, indexes)
+	if err != nil {
+		return fail(map[string]interface{}{"message": err.Error(), "statusCode": 400, "code": "INVALID_REFERENCE"})
+	}
+	p.request.Body = body
+	return p, true
+}
+
+func (g *dependencyGraph) resolve(value interface{}, indexes map[string]int) (interface{}, error) {
+	if ref, ok := refValue(value); ok {
+		if index, path, found := splitRef(ref, indexes); found {
+			resolved, ok := lookupPath(g.outcomes[index].result, path)
+			if !ok {
+				return nil, fmt.Errorf("Reference %q could not be resolved", ref)
+			}
+			return resolved, nil
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		resolved := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			r, err := g.resolve(item, indexes)
+			if err != nil {
+				return nil, err
+			}
+			resolved[key] = r
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, item := range v {
+			r, err := g.resolve(item, indexes)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	}
+	return value, nil
+}
+
+// lookupPath follows a path of keys and indexes into a result. Values that
+// are not plain maps and slices, such as structs, are seen as their JSON.
+func lookupPath(value interface{}, path []string) (interface{}, bool) {
+	converted := false
+	for i := 0; i < len(path); i++ {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			item, ok := v[path[i]]
+			if !ok {
+				return nil, false
+			}
+			value = item
+		case []interface{}:
+			n, err := strconv.Atoi(path[i])
+			if err != nil || n < 0 || n >= len(v) {
+				return nil, false
+			}
+			value = v[n]
+		default:
+			if converted || value == nil {
+				return nil, false
+			}
+			data, err := json.Marshal(value)
+			if err != nil || json.Unmarshal(data, &value) != nil {
+				return nil, false
+			}
+			converted = true
+			i--
+			continue
+		}
+		converted = false
+	}
+	return value, true
+}
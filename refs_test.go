@@ -0,0 +1,127 @@
+package blest
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferences(t *testing.T) {
+	t.Parallel()
+
+	type user struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+
+	var running sync.WaitGroup
+	running.Add(2)
+	router := NewRouter()
+	router.Route("createUser", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"id": "u1", "roles": []interface{}{"admin"}}, nil
+	})
+	router.Route("createPost", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"post": body}, nil
+	})
+	router.Route("profile", func() (interface{}, error) {
+		return map[string]interface{}{"user": user{Name: "Ada", Tags: []string{"math"}}}, nil
+	})
+	router.Route("fail", func() (interface{}, error) {
+		return nil, NewBlestError("Failed", 500)
+	})
+	router.Route("together", func() (interface{}, error) {
+		running.Done()
+		done := make(chan struct{})
+		go func() {
+			running.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return map[string]interface{}{"together": true}, nil
+		case <-time.After(time.Second):
+			return nil, NewBlestError("Ran alone", 500)
+		}
+	})
+
+	posts := func(result [][4]interface{}, id string) [4]interface{} {
+		for _, item := range result {
+			if item[0] == id {
+				return item
+			}
+		}
+		return [4]interface{}{}
+	}
+
+	// References should point to earlier items
+	result, reqErr := router.Handle([][]interface{}{
+		{"post", "createPost", map[string]interface{}{"tags": []interface{}{map[string]interface{}{"$ref": "profile.tags.0"}}}},
+		{"profile", "profile"},
+	}, map[string]interface{}{})
+	assert.Equal(t, `Reference "profile.tags.0" should point to an earlier item in the batch`, reqErr["message"])
+	assert.Equal(t, "INVALID_REFERENCE", reqErr["code"])
+	assert.Nil(t, result)
+
+	// Values that do not refer to an item in the batch are left alone
+	result, reqErr = router.Handle([][]interface{}{
+		{"user", "createUser"},
+		{"post", "createPost", map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/definitions/x"}}},
+	}, map[string]interface{}{})
+	assert.Nil(t, reqErr)
+	assert.Equal(t, map[string]interface{}{"$ref": "#/definitions/x"}, posts(result, "post")[2].(map[string]interface{})["post"].(map[string]interface{})["schema"])
+
+	// Later items receive values from the results of earlier items, while
+	// independent items run in parallel and results keep the batch order
+	result, reqErr = router.Handle([][]interface{}{
+		{"a", "together"},
+		{"user", "createUser"},
+		{"profile", "profile"},
+		{"b", "together"},
+		{"post", "createPost", map[string]interface{}{
+			"author": Ref("user", "id"),
+			"role":   Ref("user", "roles.0"),
+			"user":   Ref("user", ""),
+			"tags":   []interface{}{Ref("profile", "user.tags.0")},
+		}},
+	}, map[string]interface{}{})
+	assert.Nil(t, reqErr)
+	assert.Len(t, result, 5)
+	for i, id := range []string{"a", "user", "profile", "b", "post"} {
+		assert.Equal(t, id, result[i][0])
+	}
+	assert.Nil(t, posts(result, "a")[3])
+	assert.Nil(t, posts(result, "b")[3])
+	post := posts(result, "post")[2].(map[string]interface{})["post"].(map[string]interface{})
+	assert.Equal(t, "u1", post["author"])
+	assert.Equal(t, "admin", post["role"])
+	assert.Equal(t, "u1", post["user"].(map[string]interface{})["id"])
+	assert.Equal(t, []interface{}{"math"}, post["tags"])
+
+	// Failures spread to every dependent item
+	result, reqErr = router.Handle([][]interface{}{
+		{"x", "fail"},
+		{"y", "createPost", map[string]interface{}{"x": Ref("x", "id")}},
+		{"z", "createPost", map[string]interface{}{"y": Ref("y", "post")}},
+		{"user", "createUser"},
+		{"missing", "createPost", map[string]interface{}{"x": Ref("user", "name")}},
+	}, map[string]interface{}{})
+	assert.Nil(t, reqErr)
+	assert.Equal(t, "DEPENDENCY_FAILED", posts(result, "y")[3].(map[string]interface{})["code"])
+	assert.Equal(t, 424, posts(result, "z")[3].(map[string]interface{})["statusCode"])
+	assert.Equal(t, "INVALID_REFERENCE", posts(result, "missing")[3].(map[string]interface{})["code"])
+	assert.Nil(t, posts(result, "user")[3])
+
+	// The client batch builder refers to earlier calls through their futures
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+	batch := NewHttpClient(server.URL).Batch()
+	created := batch.Add("createUser")
+	posted := batch.Add("createPost", map[string]interface{}{"author": created.Ref("id")})
+	assert.Nil(t, batch.Send())
+	postResult, err := posted.Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, "u1", postResult["post"].(map[string]interface{})["author"])
+}
@@ -0,0 +1,204 @@
+package blest
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+var defaultRetryStatusCodes = []int{408, 425, 429, 500, 502, 503, 504}
+
+// retryPolicy decides which items of a failed batch are sent again, and how
+// long to wait before each attempt.
+type retryPolicy struct {
+	maxAttempts      int
+	delay            time.Duration
+	maxDelay         time.Duration
+	statusCodes      map[int]bool
+	idempotentRoutes map[string]bool
+}
+
+func parseRetryPolicy(options map[string]interface{}) *retryPolicy {
+	maxAttempts := 1
+	if options["maxAttempts"] != nil {
+		m, ok := options["maxAttempts"].(int)
+		if !ok || m < 1 {
+			panic("Max attempts should be a positive integer")
+		}
+		maxAttempts = m
+	}
+	if maxAttempts == 1 {
+		return nil
+	}
+	delay := 100 * time.Millisecond
+	if options["retryDelay"] != nil {
+		d, ok := options["retryDelay"].(int)
+		if !ok || d <= 0 {
+			panic("Retry delay should be a positive integer")
+		}
+		delay = time.Duration(d) * time.Millisecond
+	}
+	maxDelay := 2 * time.Second
+	if options["maxRetryDelay"] != nil {
+		d, ok := options["maxRetryDelay"].(int)
+		if !ok || d <= 0 {
+			panic("Max retry delay should be a positive integer")
+		}
+		maxDelay = time.Duration(d) * time.Millisecond
+	}
+	statusCodes := defaultRetryStatusCodes
+	if options["retryStatusCodes"] != nil {
+		codes, ok := options["retryStatusCodes"].([]int)
+		if !ok {
+			panic("Retry status codes should be a slice of integers")
+		}
+		statusCodes = codes
+	}
+	policy := &retryPolicy{
+		maxAttempts:      maxAttempts,
+		delay:            delay,
+		maxDelay:         maxDelay,
+		statusCodes:      make(map[int]bool),
+		idempotentRoutes: make(map[string]bool),
+	}
+	for _, code := range statusCodes {
+		policy.statusCodes[code] = true
+	}
+	if options["idempotentRoutes"] != nil {
+		routes, ok := options["idempotentRoutes"].([]string)
+		if !ok {
+			panic("Idempotent routes should be a slice of strings")
+		}
+		for _, route := range routes {
+			policy.idempotentRoutes[route] = true
+		}
+	}
+	return policy
+}
+
+// backoff doubles the delay for every attempt, up to the maximum, and picks
+// a random delay in its upper half so that clients do not retry in step.
+func (p *retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.delay
+	for i := 1; i < attempt && delay < p.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.maxDelay {
+		delay = p.maxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// budget is the longest the policy may wait between attempts, before the
+// random jitter of backoff is taken off.
+func (p *retryPolicy) budget() time.Duration {
+	var total time.Duration
+	delay := p.delay
+	for attempt := 1; attempt < p.maxAttempts; attempt++ {
+		if delay > p.maxDelay {
+			delay = p.maxDelay
+		}
+		total += delay
+		delay *= 2
+	}
+	return total
+}
+
+// canRetry reports whether an item is safe to send more than once.
+func (p *retryPolicy) canRetry(request []interface{}) bool {
+	route, _ := request[1].(string)
+	if p.idempotentRoutes[route] {
+		return true
+	}
+	return len(request) > 3 && idempotencyKey(request[3]) != ""
+}
+
+func (p *retryPolicy) retryableError(err error) bool {
+	if blestErr, ok := err.(*BlestError); ok {
+		return p.statusCodes[blestErr.StatusCode]
+	}
+	// Anything else means the batch never got a response, such as a refused
+	// connection or a timeout
+	return true
+}
+
+func (p *retryPolicy) retryableResult(errorValue interface{}) bool {
+	errorObject, ok := errorValue.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	statusCode, ok := intValue(errorObject["statusCode"])
+	return ok && p.statusCodes[statusCode]
+}
+
+// retryTransport sends the items of a batch again when the batch or the item
+// fails with a retryable error, for as long as the policy allows.
+type retryTransport struct {
+	transport Transport
+	policy    *retryPolicy
+}
+
+func (t *retryTransport) Send(requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	// abandonedErr is the error of an earlier attempt whose unanswered items
+	// could not be retried, and is only returned if nothing worse happens
+	var abandonedErr error
+	pending := requests
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if attempt > 1 {
+			time.Sleep(t.policy.backoff(attempt - 1))
+		}
+		final := attempt >= t.policy.maxAttempts
+		byId := make(map[string][]interface{}, len(pending))
+		for _, request := range pending {
+			if id, ok := request[0].(string); ok {
+				byId[id] = request
+			}
+		}
+
+		var retry [][]interface{}
+		answered := make(map[string]bool, len(pending))
+		err := t.transport.Send(pending, headers, func(r []interface{}) {
+			if len(r) < 4 {
+				return
+			}
+			id, _ := r[0].(string)
+			request, exists := byId[id]
+			if !exists || answered[id] {
+				return
+			}
+			answered[id] = true
+			if !final && t.policy.retryableResult(r[3]) && t.policy.canRetry(request) {
+				retry = append(retry, request)
+				return
+			}
+			respond(r)
+		})
+		if err != nil {
+			// Unanswered items that cannot be retried are left for the caller
+			// to fail with the error
+			if final || !t.policy.retryableError(err) {
+				return err
+			}
+			for _, request := range pending {
+				if id, _ := request[0].(string); answered[id] {
+					continue
+				} else if t.policy.canRetry(request) {
+					retry = append(retry, request)
+				} else {
+					abandonedErr = err
+				}
+			}
+		}
+		pending = retry
+	}
+	return abandonedErr
+}
+
+func (t *retryTransport) subscribe(ctx context.Context, requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	transport, ok := t.transport.(subscribeTransport)
+	if !ok {
+		return errSubscriptionsUnsupported
+	}
+	return transport.subscribe(ctx, requests, headers, respond)
+}
@@ -0,0 +1,247 @@
+package blest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetries(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	failures := 0
+	posts := 0
+	charges := 0
+	flaky := 0
+
+	router := NewRouter(map[string]interface{}{"idempotencyStore": NewMemoryIdempotencyStore(time.Minute)})
+	router.Route("read", func() (interface{}, error) {
+		return map[string]interface{}{"ok": true}, nil
+	})
+	router.Route("charge", func() (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		charges++
+		return map[string]interface{}{"charge": float64(charges)}, nil
+	})
+	router.Route("flaky", func() (interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		flaky++
+		if flaky == 1 {
+			return nil, NewBlestError("Try again", 503)
+		}
+		return map[string]interface{}{"flaky": float64(flaky)}, nil
+	})
+
+	handler := router.HttpHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		posts++
+		fail := failures > 0
+		if fail {
+			failures--
+		}
+		mu.Unlock()
+		if fail {
+			writeHttpError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "Service Unavailable")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	reset := func(failing int) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures, posts = failing, 0
+	}
+	sent := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return posts
+	}
+
+	client := NewHttpClient(server.URL, map[string]interface{}{
+		"maxAttempts":      3,
+		"retryDelay":       5,
+		"maxRetryDelay":    20,
+		"idempotentRoutes": []string{"read", "flaky"},
+	})
+
+	// Idempotent routes are retried through batch failures
+	reset(2)
+	result, err := client.Request("read")
+	assert.Nil(t, err)
+	assert.Equal(t, true, result["ok"])
+	assert.Equal(t, 3, sent())
+
+	reset(3)
+	_, err = client.Request("read")
+	assert.Equal(t, 503, err.(*BlestError).StatusCode)
+	assert.Equal(t, 3, sent())
+
+	// Batches and notifications succeed once a retry gets through
+	reset(1)
+	batch := client.Batch()
+	read := batch.Add("read")
+	assert.Nil(t, batch.Send())
+	result, err = read.Wait()
+	assert.Nil(t, err)
+	assert.Equal(t, true, result["ok"])
+	assert.Equal(t, 2, sent())
+
+	reset(1)
+	assert.Nil(t, client.Notify("read"))
+	assert.Equal(t, 2, sent())
+
+	// Other routes fail at once unless they carry an idempotency key
+	reset(1)
+	_, err = client.Request("charge")
+	assert.Equal(t, 503, err.(*BlestError).StatusCode)
+	assert.Equal(t, 1, sent())
+
+	reset(1)
+	keyed := map[string]interface{}{"idempotencyKey": "order-1"}
+	result, err = client.Request("charge", nil, keyed)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), result["charge"])
+	assert.Equal(t, 2, sent())
+
+	// The server runs a keyed request only once
+	result, err = client.Request("charge", nil, keyed)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), result["charge"])
+	result, err = client.Request("charge", nil, map[string]interface{}{"idempotencyKey": "order-2"})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(2), result["charge"])
+
+	// Items that fail with a retryable status are retried on their own
+	reset(0)
+	result, err = client.Request("flaky")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(2), result["flaky"])
+	assert.Equal(t, 2, sent())
+
+	policy := parseRetryPolicy(map[string]interface{}{"maxAttempts": 5, "retryDelay": 100, "maxRetryDelay": 300})
+	for attempt := 1; attempt <= 4; attempt++ {
+		delay := policy.backoff(attempt)
+		assert.LessOrEqual(t, delay, 300*time.Millisecond)
+		assert.GreaterOrEqual(t, delay, 50*time.Millisecond)
+	}
+	assert.Nil(t, parseRetryPolicy(nil))
+
+	// Calls wait through the retry delays, so the timeout has to outlast them
+	assert.Equal(t, 900*time.Millisecond, policy.budget())
+	assert.Equal(t, defaultRequestTimeout+900*time.Millisecond, parseRequestTimeout(nil, policy))
+	assert.Equal(t, time.Second, parseRequestTimeout(map[string]interface{}{"requestTimeout": 1000}, policy))
+	assert.Panics(t, func() {
+		parseRequestTimeout(map[string]interface{}{"requestTimeout": 900}, policy)
+	})
+	assert.Panics(t, func() {
+		parseRequestTimeout(map[string]interface{}{"requestTimeout": 0}, nil)
+	})
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer slow.Close()
+	client = NewHttpClient(slow.URL, map[string]interface{}{"requestTimeout": 20})
+	_, err = client.Request("read")
+	assert.EqualError(t, err, "Request timed out")
+	assert.EqualError(t, client.Notify("read"), "Request timed out")
+	assert.Panics(t, func() {
+		parseRetryPolicy(map[string]interface{}{"maxAttempts": 0})
+	})
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	router := NewRouter(map[string]interface{}{"idempotencyStore": NewMemoryIdempotencyStore(time.Minute)})
+	router.Route("slow", func() (interface{}, error) {
+		calls++
+		time.Sleep(50 * time.Millisecond)
+		return map[string]interface{}{"done": true}, nil
+	})
+	router.Route("broken", func() (interface{}, error) {
+		calls++
+		return nil, NewBlestError("Broken", 500)
+	})
+
+	// A duplicate that arrives while the first request runs is a conflict
+	headers := map[string]interface{}{"idempotencyKey": "k"}
+	var result [][4]interface{}
+	var mu sync.Mutex
+	reqErr := router.HandleStream([][]interface{}{{"a", "slow", nil, headers}, {"b", "slow", nil, headers}}, map[string]interface{}{}, func(item [4]interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		result = append(result, item)
+	})
+	assert.Nil(t, reqErr)
+	assert.Equal(t, 1, calls)
+	conflicts := 0
+	for _, item := range result {
+		if item[3] != nil {
+			assert.Equal(t, "IDEMPOTENCY_CONFLICT", item[3].(map[string]interface{})["code"])
+			conflicts++
+		}
+	}
+	assert.Equal(t, 1, conflicts)
+
+	// Server errors release the key
+	router.Handle([][]interface{}{{"a", "broken", nil, headers}}, map[string]interface{}{})
+	router.Handle([][]interface{}{{"a", "broken", nil, headers}}, map[string]interface{}{})
+	assert.Equal(t, 3, calls)
+
+	// Keys reused with a different body are rejected rather than replayed
+	calls = 0
+	router.Route("create", func(body map[string]interface{}) (interface{}, error) {
+		calls++
+		return map[string]interface{}{"name": body["name"]}, nil
+	})
+	headers = map[string]interface{}{"idempotencyKey": "c"}
+	router.Handle([][]interface{}{{"a", "create", map[string]interface{}{"name": "one"}, headers}}, map[string]interface{}{})
+	result, _ = router.Handle([][]interface{}{{"a", "create", map[string]interface{}{"name": "one"}, headers}}, map[string]interface{}{})
+	assert.Equal(t, "one", result[0][2].(map[string]interface{})["name"])
+	result, _ = router.Handle([][]interface{}{{"a", "create", map[string]interface{}{"name": "two"}, headers}}, map[string]interface{}{})
+	assert.Equal(t, 422, result[0][3].(map[string]interface{})["statusCode"])
+	assert.Equal(t, "IDEMPOTENCY_KEY_REUSED", result[0][3].(map[string]interface{})["code"])
+	assert.Equal(t, 1, calls)
+
+	// Scopes keep the keys of different callers apart
+	scoped := NewRouter(map[string]interface{}{
+		"idempotencyStore": NewMemoryIdempotencyStore(time.Minute),
+		"idempotencyScope": func(context map[string]interface{}) string {
+			user, _ := context["user"].(string)
+			return user
+		},
+	})
+	scoped.Route("whoami", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"user": context["user"]}, nil
+	})
+	for _, user := range []string{"ada", "bob"} {
+		result, _ = scoped.Handle([][]interface{}{{"a", "whoami", nil, headers}}, map[string]interface{}{"user": user})
+		assert.Equal(t, user, result[0][2].(map[string]interface{})["user"])
+	}
+	assert.Panics(t, func() {
+		NewRouter(map[string]interface{}{"idempotencyScope": "user"})
+	})
+
+	store := NewMemoryIdempotencyStore(10 * time.Millisecond)
+	_, claimed, _ := store.Reserve("x")
+	assert.True(t, claimed)
+	_, claimed, _ = store.Reserve("x")
+	assert.False(t, claimed)
+	time.Sleep(20 * time.Millisecond)
+	_, claimed, _ = store.Reserve("x")
+	assert.True(t, claimed)
+	assert.NotNil(t, store.Complete("y", IdempotentResult{}))
+}
@@ -0,0 +1,125 @@
+package blest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	signatureKeyIdHeader     = "Blest-Key-Id"
+	signatureTimestampHeader = "Blest-Timestamp"
+	signatureHeader          = "Blest-Signature"
+)
+
+// computeSignature signs the timestamp, method, path with its query and a
+// hash of the body, which is taken after encryption but before compression.
+func computeSignature(key []byte, timestamp, method, path string, body []byte) string {
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + path + "\n" + hex.EncodeToString(bodyHash[:])))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validateSigningKey(key []byte) {
+	if len(key) < 16 {
+		panic("Signing keys should be at least 16 bytes")
+	}
+}
+
+// signingConfig holds the keys a server verifies signatures with, by key ID,
+// and how far a timestamp may drift from the server clock.
+type signingConfig struct {
+	keys   map[string][]byte
+	window time.Duration
+}
+
+func parseSigningConfig(options map[string]interface{}) *signingConfig {
+	if options["signingKeys"] == nil {
+		return nil
+	}
+	keys, ok := options["signingKeys"].(map[string][]byte)
+	if !ok || len(keys) == 0 {
+		panic("Signing keys should be a map of key IDs to keys")
+	}
+	for keyID, key := range keys {
+		if keyID == "" {
+			panic("Signing key IDs should not be empty")
+		}
+		validateSigningKey(key)
+	}
+	window := 5 * time.Minute
+	if options["signatureWindow"] != nil {
+		w, ok := options["signatureWindow"].(int)
+		if !ok || w <= 0 {
+			panic("Signature window should be a positive integer")
+		}
+		window = time.Duration(w) * time.Millisecond
+	}
+	return &signingConfig{keys: keys, window: window}
+}
+
+// verify checks the signature headers of a request and returns the key ID
+// it was signed with.
+func (c *signingConfig) verify(r *http.Request, body []byte, now time.Time) (string, *BlestError) {
+	keyID := r.Header.Get(signatureKeyIdHeader)
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	signature := r.Header.Get(signatureHeader)
+	if keyID == "" || timestamp == "" || signature == "" {
+		return "", &BlestError{Message: "Request should be signed", StatusCode: 401, Code: "SIGNATURE_REQUIRED"}
+	}
+	key, exists := c.keys[keyID]
+	if !exists {
+		return "", &BlestError{Message: fmt.Sprintf("Unknown signing key: %s", keyID), StatusCode: 401, Code: "UNKNOWN_KEY"}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", &BlestError{Message: "Invalid signature timestamp", StatusCode: 401, Code: "INVALID_SIGNATURE"}
+	}
+	expected := computeSignature(key, timestamp, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", &BlestError{Message: "Invalid request signature", StatusCode: 401, Code: "INVALID_SIGNATURE"}
+	}
+	drift := now.Sub(time.Unix(seconds, 0))
+	if drift > c.window || drift < -c.window {
+		return "", &BlestError{Message: "Request signature has expired", StatusCode: 401, Code: "SIGNATURE_EXPIRED"}
+	}
+	return keyID, nil
+}
+
+// requestSigner signs outgoing requests with a single key.
+type requestSigner struct {
+	keyID string
+	key   []byte
+}
+
+func parseRequestSigner(options map[string]interface{}) *requestSigner {
+	if options["signingKey"] == nil {
+		return nil
+	}
+	key, ok := options["signingKey"].([]byte)
+	if !ok {
+		panic("Signing key should be a byte slice")
+	}
+	validateSigningKey(key)
+	keyID, _ := options["signingKeyId"].(string)
+	if keyID == "" {
+		panic("Signing key ID is required")
+	}
+	return &requestSigner{keyID: keyID, key: key}
+}
+
+func (s *requestSigner) sign(request *http.Request, body []byte, now time.Time) {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	request.Header.Set(signatureKeyIdHeader, s.keyID)
+	request.Header.Set(signatureTimestampHeader, timestamp)
+	request.Header.Set(signatureHeader, computeSignature(s.key, timestamp, request.Method, request.URL.RequestURI(), body))
+}
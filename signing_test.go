@@ -0,0 +1,99 @@
+package blest
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigning(t *testing.T) {
+	t.Parallel()
+
+	key := bytes.Repeat([]byte{7}, 32)
+
+	router := NewRouter(map[string]interface{}{
+		"signingKeys":     map[string][]byte{"service-a": key},
+		"signatureWindow": 60000,
+	})
+	router.Route("whoami", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"keyId": context["signingKeyId"]}, nil
+	})
+
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+
+	// Signed batches are accepted and the key ID reaches the handler
+	client := NewHttpClient(server.URL, map[string]interface{}{"signingKeyId": "service-a", "signingKey": key, "compression": "gzip"})
+	result, err := client.Request("whoami", map[string]interface{}{"padding": strings.Repeat("x", 2048)})
+	assert.Nil(t, err)
+	assert.Equal(t, "service-a", result["keyId"])
+
+	// Unsigned batches and batches signed with the wrong key are rejected
+	client = NewHttpClient(server.URL)
+	_, err = client.Request("whoami")
+	assert.Equal(t, "SIGNATURE_REQUIRED", err.(*BlestError).Code)
+	assert.Equal(t, 401, err.(*BlestError).StatusCode)
+
+	client = NewHttpClient(server.URL, map[string]interface{}{"signingKeyId": "service-a", "signingKey": bytes.Repeat([]byte{8}, 32)})
+	_, err = client.Request("whoami")
+	assert.Equal(t, "INVALID_SIGNATURE", err.(*BlestError).Code)
+
+	client = NewHttpClient(server.URL, map[string]interface{}{"signingKeyId": "service-b", "signingKey": key})
+	_, err = client.Request("whoami")
+	assert.Equal(t, "UNKNOWN_KEY", err.(*BlestError).Code)
+
+	post := func(body string, signedAt time.Time) (int, string) {
+		request, _ := http.NewRequest("POST", server.URL, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		(&requestSigner{keyID: "service-a", key: key}).sign(request, []byte(`[["a","whoami"]]`), signedAt)
+		response, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		responseBody, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(responseBody)
+	}
+
+	// Tampered bodies and replays outside the window are rejected
+	status, _ := post(`[["a","whoami"]]`, time.Now())
+	assert.Equal(t, 200, status)
+	status, body := post(`[["b","whoami"]]`, time.Now())
+	assert.Equal(t, 401, status)
+	assert.Contains(t, body, "INVALID_SIGNATURE")
+	status, body = post(`[["a","whoami"]]`, time.Now().Add(-2*time.Minute))
+	assert.Equal(t, 401, status)
+	assert.Contains(t, body, "SIGNATURE_EXPIRED")
+	status, body = post(`[["a","whoami"]]`, time.Now().Add(2*time.Minute))
+	assert.Equal(t, 401, status)
+	assert.Contains(t, body, "SIGNATURE_EXPIRED")
+
+	// Signed GET responses are private and vary with the signature
+	assert.Nil(t, router.Describe("whoami", map[string]interface{}{"cacheable": true, "maxAge": 60}))
+	request, _ := http.NewRequest("GET", server.URL+"?b="+encodeBatchQuery([]byte(`[["a","whoami"]]`)), nil)
+	(&requestSigner{keyID: "service-a", key: key}).sign(request, nil, time.Now())
+	response, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	response.Body.Close()
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "private, max-age=60", response.Header.Get("Cache-Control"))
+	for _, header := range []string{"Authorization", "Blest-Key-Id", "Blest-Timestamp", "Blest-Signature"} {
+		assert.Contains(t, response.Header.Get("Vary"), header)
+	}
+
+	assert.Panics(t, func() {
+		NewHttpClient(server.URL, map[string]interface{}{"signingKeyId": "short", "signingKey": []byte("short")})
+	})
+	assert.Panics(t, func() {
+		NewHttpHandler(nil, map[string]interface{}{"signingKeys": map[string][]byte{"a": key}, "signatureWindow": -1})
+	})
+
+	// WebSocket frames are not signed, so they cannot bypass verification
+	assert.Panics(t, func() {
+		NewHttpHandler(nil, map[string]interface{}{"signingKeys": map[string][]byte{"a": key}, "websocket": true})
+	})
+}
@@ -0,0 +1,173 @@
+package blest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Batches sent over a raw socket are framed with a 4-byte big-endian length
+// prefix. Every request frame is answered by exactly one response frame, in
+// the order the requests were received, holding either the result tuples or
+// a batch error object.
+
+func writeFrame(w io.Writer, payload []byte) error {
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+var errFrameTooLarge = errors.New("frame is too large")
+
+func readFrame(r io.Reader, maxSize int64) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[:]))
+	if maxSize > 0 && size > maxSize {
+		return nil, errFrameTooLarge
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// ListenAndServe listens on a "unix" or "tcp" address and serves framed
+// batches on it.
+func (r *Router) ListenAndServe(network, address string) error {
+	switch network {
+	case "unix", "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("unsupported network: %s", network)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return r.Serve(listener)
+}
+
+// Serve accepts connections on listener until it is closed, handling the
+// frames on each connection concurrently.
+func (r *Router) Serve(listener net.Listener) error {
+	codec := findCodec(parseCodecs(r.Options), "application/json")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go r.serveConn(conn, codec)
+	}
+}
+
+func (r *Router) serveConn(conn net.Conn, codec Codec) {
+	defer conn.Close()
+
+	context := map[string]interface{}{
+		"remoteAddr": conn.RemoteAddr().String(),
+	}
+
+	reader := bufio.NewReader(conn)
+	next := func() ([]byte, error) {
+		frame, err := readFrame(reader, r.limits.maxBodySize)
+		if errors.Is(err, errFrameTooLarge) {
+			return nil, &BlestError{Message: fmt.Sprintf("Request body should be at most %d bytes", r.limits.maxBodySize), StatusCode: 413, Code: "BODY_TOO_LARGE"}
+		}
+		return frame, err
+	}
+	write := func(payload []byte) error {
+		err := writeFrame(conn, payload)
+		if err != nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := r.serveOrdered(codec, context, next, write); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		log.Println(err)
+	}
+}
+
+// SocketTransport sends framed batches over a single Unix or TCP connection,
+// which is dialled on first use and again after it fails.
+type SocketTransport struct {
+	pipeline *pipeline
+}
+
+func NewSocketTransport(network, address string, args ...interface{}) *SocketTransport {
+	var options map[string]interface{}
+	if len(args) > 0 {
+		o, oOk := args[0].(map[string]interface{})
+		if oOk {
+			options = o
+		}
+	}
+	dialTimeout := 10 * time.Second
+	if options["dialTimeout"] != nil {
+		d, ok := options["dialTimeout"].(int)
+		if !ok || d <= 0 {
+			panic("Dial timeout should be a positive integer")
+		}
+		dialTimeout = time.Duration(d) * time.Millisecond
+	}
+	maxResponseSize := int64(defaultMaxBodySize * 16)
+	if options["maxResponseSize"] != nil {
+		m, ok := options["maxResponseSize"].(int)
+		if !ok || m <= 0 {
+			panic("Max response size should be a positive integer")
+		}
+		maxResponseSize = int64(m)
+	}
+	useNumber, _ := options["useNumber"].(bool)
+	return &SocketTransport{
+		pipeline: &pipeline{
+			codec: JSONCodec{UseNumber: useNumber},
+			open: func() (pipelineConn, error) {
+				conn, err := net.DialTimeout(network, address, dialTimeout)
+				if err != nil {
+					return nil, err
+				}
+				return &framedConn{conn: conn, reader: bufio.NewReader(conn), maxSize: maxResponseSize}, nil
+			},
+		},
+	}
+}
+
+func (t *SocketTransport) Send(requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	return t.pipeline.send(requests, respond)
+}
+
+// Close closes the connection, failing any batches still in flight.
+func (t *SocketTransport) Close() error {
+	return t.pipeline.close()
+}
+
+type framedConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	maxSize int64
+}
+
+func (c *framedConn) write(payload []byte) error {
+	return writeFrame(c.conn, payload)
+}
+
+func (c *framedConn) read() ([]byte, error) {
+	return readFrame(c.reader, c.maxSize)
+}
+
+func (c *framedConn) Close() error {
+	return c.conn.Close()
+}
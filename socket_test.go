@@ -0,0 +1,108 @@
+package blest
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSocketTransport(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter(map[string]interface{}{"maxBodySize": 1024})
+	router.Route("echo", func(body map[string]interface{}) (interface{}, error) {
+		return body, nil
+	})
+	router.Route("slow", func(body map[string]interface{}) (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return map[string]interface{}{"slow": true}, nil
+	})
+	router.Route("fail", func() (interface{}, error) {
+		return nil, NewBlestError("Nope", 418, "TEAPOT")
+	})
+
+	unixListener, err := net.Listen("unix", filepath.Join(t.TempDir(), "blest.sock"))
+	assert.Nil(t, err)
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go router.Serve(unixListener)
+	go router.Serve(tcpListener)
+	defer unixListener.Close()
+	defer tcpListener.Close()
+
+	for _, listener := range []net.Listener{unixListener, tcpListener} {
+		network := listener.Addr().Network()
+		transport := NewSocketTransport(network, listener.Addr().String())
+		client := NewHttpClient("", map[string]interface{}{"transport": transport})
+
+		// Batches are pipelined on one connection
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				route := "echo"
+				if i%2 == 0 {
+					route = "slow"
+				}
+				_, err := client.Request(route, map[string]interface{}{"i": float64(i)})
+				assert.Nil(t, err, network)
+			}(i)
+			time.Sleep(2 * time.Millisecond)
+		}
+		wg.Wait()
+
+		result, err := client.Request("echo", map[string]interface{}{"hello": "world"}, map[string]interface{}{"_s": []interface{}{"hello"}})
+		assert.Nil(t, err, network)
+		assert.Equal(t, map[string]interface{}{"hello": "world"}, result, network)
+
+		_, err = client.Request("fail")
+		assert.Equal(t, "TEAPOT", err.(*BlestError).Code, network)
+
+		// Oversized frames are rejected and close the connection
+		_, err = client.Request("echo", map[string]interface{}{"big": strings.Repeat("x", 2048)})
+		assert.Equal(t, "BODY_TOO_LARGE", err.(*BlestError).Code, network)
+
+		// The transport reconnects on the next batch
+		result, err = client.Request("echo", map[string]interface{}{"again": true})
+		assert.Nil(t, err, network)
+		assert.Equal(t, true, result["again"], network)
+
+		assert.Nil(t, transport.Close())
+		_, err = client.Request("echo")
+		assert.NotNil(t, err, network)
+	}
+
+	// Responses come back in request order, even when invalid
+	conn, err := net.Dial("tcp", tcpListener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, writeFrame(conn, []byte(`[["a","slow"]]`)))
+	assert.Nil(t, writeFrame(conn, []byte(`not json`)))
+	reader := bufio.NewReader(conn)
+	first, err := readFrame(reader, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, string(first), `"slow":true`)
+	second, err := readFrame(reader, 0)
+	assert.Nil(t, err)
+	assert.Contains(t, string(second), "INVALID_JSON")
+
+	// The transport refuses responses larger than its limit, whatever the
+	// frame header claims
+	limited := NewSocketTransport("tcp", tcpListener.Addr().String(), map[string]interface{}{"maxResponseSize": 64})
+	limitedClient := NewHttpClient("", map[string]interface{}{"transport": limited})
+	_, err = limitedClient.Request("echo", map[string]interface{}{"big": strings.Repeat("x", 100)})
+	assert.ErrorIs(t, err, errFrameTooLarge)
+	limited.Close()
+	assert.Panics(t, func() {
+		NewSocketTransport("tcp", tcpListener.Addr().String(), map[string]interface{}{"maxResponseSize": 0})
+	})
+
+	assert.NotNil(t, router.ListenAndServe("udp", "127.0.0.1:0"))
+}
@@ -0,0 +1,148 @@
+package blest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ServeStdio serves newline-delimited JSON batches on standard input and
+// writes one line per batch to standard output, in the order the batches
+// were received. It returns once standard input is closed.
+func ServeStdio(router *Router) error {
+	return router.serveLines(os.Stdin, os.Stdout)
+}
+
+func (r *Router) serveLines(in io.Reader, out io.Writer) error {
+	codec := findCodec(parseCodecs(r.Options), "application/json")
+	scanner := bufio.NewScanner(in)
+	maxSize := int(r.limits.maxBodySize)
+	if maxSize <= 0 {
+		maxSize = math.MaxInt
+	}
+	initialSize := 4096
+	if maxSize < initialSize {
+		initialSize = maxSize
+	}
+	scanner.Buffer(make([]byte, 0, initialSize), maxSize)
+
+	next := func() ([]byte, error) {
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			return append([]byte{}, line...), nil
+		}
+		if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+			return nil, &BlestError{Message: fmt.Sprintf("Request body should be at most %d bytes", maxSize), StatusCode: 413, Code: "BODY_TOO_LARGE"}
+		} else if scanner.Err() != nil {
+			return nil, scanner.Err()
+		}
+		return nil, io.EOF
+	}
+	write := func(payload []byte) error {
+		_, err := out.Write(append(payload, '\n'))
+		return err
+	}
+	err := r.serveOrdered(codec, map[string]interface{}{}, next, write)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// StdioTransport runs a command that serves BLEST on its standard input and
+// output, such as one calling ServeStdio. The command is started on first
+// use and again if it exits.
+type StdioTransport struct {
+	pipeline *pipeline
+}
+
+func NewStdioTransport(name string, args ...string) *StdioTransport {
+	if name == "" {
+		panic("Command is required")
+	}
+	return &StdioTransport{
+		pipeline: &pipeline{
+			codec: JSONCodec{},
+			open: func() (pipelineConn, error) {
+				cmd := exec.Command(name, args...)
+				cmd.Stderr = os.Stderr
+				stdin, err := cmd.StdinPipe()
+				if err != nil {
+					return nil, err
+				}
+				stdout, err := cmd.StdoutPipe()
+				if err != nil {
+					return nil, err
+				}
+				if err := cmd.Start(); err != nil {
+					return nil, err
+				}
+				return &processConn{cmd: cmd, stdin: stdin, reader: bufio.NewReader(stdout), exited: make(chan struct{})}, nil
+			},
+		},
+	}
+}
+
+func (t *StdioTransport) Send(requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	return t.pipeline.send(requests, respond)
+}
+
+// Close closes the standard input of the command, failing any batches still
+// in flight, and kills it if it does not exit promptly.
+func (t *StdioTransport) Close() error {
+	return t.pipeline.close()
+}
+
+type processConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	reader *bufio.Reader
+	exited chan struct{}
+	wait   sync.Once
+}
+
+func (c *processConn) write(payload []byte) error {
+	_, err := c.stdin.Write(append(payload, '\n'))
+	return err
+}
+
+func (c *processConn) read() ([]byte, error) {
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			// Wait closes standard output, so it only runs once every
+			// response has been read
+			c.wait.Do(func() {
+				go func() {
+					c.cmd.Wait()
+					close(c.exited)
+				}()
+			})
+			return nil, err
+		}
+		if len(line) > 1 {
+			return line[:len(line)-1], nil
+		}
+	}
+}
+
+func (c *processConn) Close() error {
+	err := c.stdin.Close()
+	go func() {
+		select {
+		case <-c.exited:
+		case <-time.After(5 * time.Second):
+			c.cmd.Process.Kill()
+		}
+	}()
+	return err
+}
@@ -0,0 +1,137 @@
+package blest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func stdioTestRouter() *Router {
+	router := NewRouter()
+	router.Route("echo", func(body map[string]interface{}) (interface{}, error) {
+		return body, nil
+	})
+	router.Route("pid", func() (interface{}, error) {
+		return map[string]interface{}{"pid": os.Getpid()}, nil
+	})
+	router.Route("timeout", func() (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return nil, nil
+	}, map[string]interface{}{"timeout": 10.0})
+	router.Route("exit", func() (interface{}, error) {
+		os.Exit(0)
+		return nil, nil
+	})
+	return router
+}
+
+// TestStdioHelperProcess is not a real test. It serves stdioTestRouter, or
+// writes a burst of lines and exits, when the test binary is spawned by the
+// tests below.
+func TestStdioHelperProcess(t *testing.T) {
+	if len(os.Args) < 2 {
+		return
+	}
+	switch os.Args[len(os.Args)-1] {
+	case "blest-stdio-helper":
+		ServeStdio(stdioTestRouter())
+		os.Exit(0)
+	case "blest-stdio-burst":
+		for i := 0; i < 100; i++ {
+			fmt.Println(`[["a","echo",null,null]]`)
+		}
+		os.Exit(0)
+	}
+}
+
+func TestStdioTransport(t *testing.T) {
+	t.Parallel()
+
+	transport := NewStdioTransport(os.Args[0], "-test.run=^TestStdioHelperProcess$", "--", "blest-stdio-helper")
+	defer transport.Close()
+	client := NewHttpClient("", map[string]interface{}{"transport": transport})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, err := client.Request("echo", map[string]interface{}{"i": float64(i)})
+			assert.Nil(t, err)
+			assert.Equal(t, float64(i), result["i"])
+		}(i)
+	}
+	wg.Wait()
+
+	// Timeouts are logged to standard error, so later responses still reach
+	// their callers
+	_, err := client.Request("timeout")
+	assert.Equal(t, 500, err.(*BlestError).StatusCode)
+	time.Sleep(60 * time.Millisecond)
+	result, err := client.Request("echo", map[string]interface{}{"after": "timeout"})
+	assert.Nil(t, err)
+	assert.Equal(t, "timeout", result["after"])
+
+	result, err = client.Request("pid")
+	assert.Nil(t, err)
+	pid := result["pid"]
+	assert.NotEqual(t, float64(os.Getpid()), pid)
+
+	_, err = client.Request("missing")
+	assert.Equal(t, 404, err.(*BlestError).StatusCode)
+
+	// The command is restarted after it exits
+	_, err = client.Request("exit")
+	assert.NotNil(t, err)
+	result, err = client.Request("pid")
+	assert.Nil(t, err)
+	assert.NotEqual(t, pid, result["pid"])
+}
+
+func TestStdioTransportExit(t *testing.T) {
+	t.Parallel()
+
+	// Responses written just before the command exits are still read
+	transport := NewStdioTransport(os.Args[0], "-test.run=^TestStdioHelperProcess$", "--", "blest-stdio-burst")
+	conn, err := transport.pipeline.open()
+	assert.Nil(t, err)
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	lines := 0
+	for {
+		if _, err := conn.read(); err != nil {
+			break
+		}
+		lines++
+	}
+	assert.Equal(t, 100, lines)
+	select {
+	case <-conn.(*processConn).exited:
+	case <-time.After(time.Second):
+		t.Fatal("command was not waited for")
+	}
+}
+
+func TestServeLines(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter(map[string]interface{}{"maxBodySize": 64})
+	router.Route("echo", func(body map[string]interface{}) (interface{}, error) {
+		return body, nil
+	})
+
+	in := strings.NewReader("[[\"a\",\"echo\",{\"n\":1}]]\n\nnot json\n[[\"b\",\"echo\",{\"long\":\"" + strings.Repeat("x", 100) + "\"}]]\n[[\"c\",\"echo\"]]\n")
+	var out bytes.Buffer
+	assert.Nil(t, router.serveLines(in, &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, `[["a","echo",{"n":1},null]]`, lines[0])
+	assert.Contains(t, lines[1], "INVALID_JSON")
+	assert.Contains(t, lines[2], "BODY_TOO_LARGE")
+}
@@ -0,0 +1,125 @@
+package blest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// StreamHandler runs a batch and calls emit with each result tuple as soon as
+// it is ready. It returns a batch-level error, if any, before emitting.
+type StreamHandler func(requests [][]interface{}, context map[string]interface{}, emit func([4]interface{})) map[string]interface{}
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	sseContentType    = "text/event-stream"
+)
+
+func (r *Router) HandleStream(requests [][]interface{}, context map[string]interface{}, emit func([4]interface{})) map[string]interface{} {
+	if limitErr := r.limits.check(requests); limitErr != nil {
+		_, reqErr := handleError(limitErr.StatusCode, limitErr.Code, limitErr.Message)
+		return reqErr
+	}
+	var mu sync.Mutex
+	return handleRequestStream(r.Routes, requests, withIdempotencyStore(context, r.idempotency, r.idempotencyScope), true, func(index int, result [4]interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		emit(result)
+	})
+}
+
+// bufferedStreamHandler adapts a RequestHandler, emitting its results once
+// the whole batch has completed.
+func bufferedStreamHandler(requestHandler RequestHandler) StreamHandler {
+	return func(requests [][]interface{}, context map[string]interface{}, emit func([4]interface{})) map[string]interface{} {
+		result, reqErr := requestHandler(requests, context)
+		if reqErr != nil {
+			return reqErr
+		}
+		for _, item := range result {
+			emit(item)
+		}
+		return nil
+	}
+}
+
+// acceptedStreamType returns the streaming content type requested by the
+// Accept header, or an empty string for a regular buffered response.
+func acceptedStreamType(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType == ndjsonContentType || mediaType == sseContentType {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// streamWriter writes result tuples to an HTTP response as NDJSON lines or
+// server-sent events, flushing after each one. Headers are only written
+// with the first tuple so that batch-level errors can still use a status.
+type streamWriter struct {
+	mu          sync.Mutex
+	w           http.ResponseWriter
+	contentType string
+	started     bool
+}
+
+func (sw *streamWriter) write(result [4]interface{}) {
+	line, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err)
+		line, _ = json.Marshal([4]interface{}{result[0], result[1], nil, map[string]interface{}{"message": err.Error(), "statusCode": 500}})
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if !sw.started {
+		sw.w.Header().Set("Content-Type", sw.contentType)
+		sw.w.Header().Set("Cache-Control", "no-cache")
+		sw.w.WriteHeader(http.StatusOK)
+		sw.started = true
+	}
+	if sw.contentType == sseContentType {
+		fmt.Fprintf(sw.w, "data: %s\n\n", line)
+	} else {
+		sw.w.Write(line)
+		sw.w.Write([]byte("\n"))
+	}
+	if flusher, ok := sw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// readStream reads NDJSON lines or server-sent events from body and calls
+// respond with each decoded result tuple.
+func readStream(body io.Reader, contentType string, codec Codec, respond func([]interface{})) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), defaultMaxBodySize*16)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if contentType == sseContentType {
+			if !strings.HasPrefix(string(line), "data:") {
+				continue
+			}
+			line = []byte(strings.TrimSpace(string(line[len("data:"):])))
+		}
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var result []interface{}
+		if err := codec.Unmarshal(line, &result); err != nil {
+			return fmt.Errorf("failed to unmarshal JSON: %w", err)
+		}
+		respond(result)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,113 @@
+package blest
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreaming(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var finished []string
+	router := NewRouter()
+	router.Route("fastRoute", func(body map[string]interface{}) (interface{}, error) {
+		mu.Lock()
+		finished = append(finished, "fast")
+		mu.Unlock()
+		return map[string]interface{}{"speed": "fast"}, nil
+	})
+	router.Route("slowRoute", func(body map[string]interface{}) (interface{}, error) {
+		time.Sleep(300 * time.Millisecond)
+		mu.Lock()
+		finished = append(finished, "slow")
+		mu.Unlock()
+		return map[string]interface{}{"speed": "slow"}, nil
+	})
+
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+
+	batch := `[["a","slowRoute"],["b","fastRoute"]]`
+
+	// Buffered batches run one item after another and keep their order
+	result, reqErr := router.Handle([][]interface{}{{"a", "slowRoute"}, {"b", "fastRoute"}}, nil)
+	assert.Nil(t, reqErr)
+	assert.Equal(t, "a", result[0][0])
+	assert.Equal(t, "b", result[1][0])
+	mu.Lock()
+	assert.Equal(t, []string{"slow", "fast"}, finished)
+	mu.Unlock()
+
+	// NDJSON responses are flushed item by item
+	request, _ := http.NewRequest("POST", server.URL, strings.NewReader(batch))
+	request.Header.Set("Accept", ndjsonContentType)
+	start := time.Now()
+	response, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	assert.Equal(t, ndjsonContentType, response.Header.Get("Content-Type"))
+	reader := bufio.NewReader(response.Body)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(250*time.Millisecond))
+	var first []interface{}
+	assert.Nil(t, json.Unmarshal([]byte(line), &first))
+	assert.Equal(t, "b", first[0])
+	line, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	var second []interface{}
+	assert.Nil(t, json.Unmarshal([]byte(line), &second))
+	assert.Equal(t, "a", second[0])
+	response.Body.Close()
+
+	// Server-sent events
+	request, _ = http.NewRequest("POST", server.URL, strings.NewReader(`[["a","fastRoute"]]`))
+	request.Header.Set("Accept", sseContentType)
+	response, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	assert.Equal(t, sseContentType, response.Header.Get("Content-Type"))
+	reader = bufio.NewReader(response.Body)
+	line, _ = reader.ReadString('\n')
+	assert.Equal(t, `data: ["a","fastRoute",{"speed":"fast"},null]`+"\n", line)
+	response.Body.Close()
+
+	// Batch errors are still returned with a status code
+	request, _ = http.NewRequest("POST", server.URL, strings.NewReader(`[["a","fastRoute"],["a","fastRoute"]]`))
+	request.Header.Set("Accept", ndjsonContentType)
+	response, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	assert.Equal(t, 400, response.StatusCode)
+	response.Body.Close()
+
+	// The streaming client resolves each request as its line arrives
+	client := NewHttpClient(server.URL, map[string]interface{}{"stream": true})
+	var wg sync.WaitGroup
+	var fastElapsed, slowElapsed time.Duration
+	start = time.Now()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result, err := client.Request("slowRoute", nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "slow", result["speed"])
+		slowElapsed = time.Since(start)
+	}()
+	go func() {
+		defer wg.Done()
+		result, err := client.Request("fastRoute", nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "fast", result["speed"])
+		fastElapsed = time.Since(start)
+	}()
+	wg.Wait()
+	assert.Less(t, int64(fastElapsed), int64(250*time.Millisecond))
+	assert.GreaterOrEqual(t, int64(slowElapsed), int64(300*time.Millisecond))
+}
@@ -0,0 +1,397 @@
+package blest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SubscriptionHandler streams values to a subscriber by calling emit until it
+// returns or done is closed. Returning an error ends the stream with it.
+type SubscriptionHandler func(body map[string]interface{}, context map[string]interface{}, emit func(interface{}) error, done <-chan struct{}) error
+
+const subscriptionsContextKey = "subscriptions"
+
+// subscriptionSet tracks the active subscriptions on a single persistent
+// connection so that they can be cancelled individually or all at once.
+type subscriptionSet struct {
+	mu     sync.Mutex
+	active map[string]chan struct{}
+	closed bool
+}
+
+func newSubscriptionSet() *subscriptionSet {
+	return &subscriptionSet{active: make(map[string]chan struct{})}
+}
+
+func (s *subscriptionSet) start(id string) (<-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, false
+	}
+	if _, exists := s.active[id]; exists {
+		return nil, false
+	}
+	done := make(chan struct{})
+	s.active[id] = done
+	return done, true
+}
+
+func (s *subscriptionSet) cancel(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	done, exists := s.active[id]
+	if !exists {
+		return false
+	}
+	close(done)
+	delete(s.active, id)
+	return true
+}
+
+func (s *subscriptionSet) finish(id string, done <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if active, exists := s.active[id]; exists && active == done {
+		close(active)
+		delete(s.active, id)
+	}
+}
+
+func (s *subscriptionSet) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for id, done := range s.active {
+		close(done)
+		delete(s.active, id)
+	}
+}
+
+func (r *Router) Subscribe(route string, handler SubscriptionHandler, args ...interface{}) {
+	var options map[string]interface{}
+	if len(args) > 0 {
+		o, ok := args[0].(map[string]interface{})
+		if !ok {
+			panic("Options should be a map")
+		}
+		options = o
+	}
+
+	routeError := validateRoute(route, false)
+	if routeError != "" {
+		panic(routeError)
+	} else if _, exists := r.Routes[route]; exists {
+		panic("Route already exists")
+	} else if handler == nil {
+		panic("Subscription handler is required")
+	}
+
+	r.Routes[route] = Route{
+		Handler:      append([]interface{}{}, r.Middleware...),
+		Description:  "",
+		Schema:       nil,
+		Visible:      r.Introspection,
+		Validate:     false,
+		Timeout:      r.Timeout,
+		Subscription: handler,
+	}
+
+	if options != nil {
+		r.Describe(route, options)
+	}
+}
+
+// unsubscribe handles the _unsubscribe system route, which cancels a
+// subscription started earlier on the same connection.
+func unsubscribe(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+	subscriptions, _ := context[subscriptionsContextKey].(*subscriptionSet)
+	if subscriptions == nil {
+		return nil, NewBlestError("Subscriptions require a persistent connection", 400, "SUBSCRIPTIONS_UNSUPPORTED")
+	}
+	id, _ := body["id"].(string)
+	if id == "" || !subscriptions.cancel(id) {
+		return nil, NewBlestError("Subscription not found", 404, "NOT_FOUND")
+	}
+	return nil, nil
+}
+
+// runSubscription runs the route middleware, then the subscription handler,
+// emitting a tuple for every value and a final tuple with a nil result, or
+// an error, once the stream ends.
+func runSubscription(p preparedRequest, subscription SubscriptionHandler, emit func([4]interface{})) {
+	id, route := p.request.ID, p.request.Route
+
+	subscriptions, _ := p.context[subscriptionsContextKey].(*subscriptionSet)
+	if subscriptions == nil {
+		emit([4]interface{}{id, route, nil, map[string]interface{}{"message": "Subscriptions require a persistent connection", "statusCode": 400, "code": "SUBSCRIPTIONS_UNSUPPORTED"}})
+		return
+	}
+	done, ok := subscriptions.start(id)
+	if !ok {
+		emit([4]interface{}{id, route, nil, map[string]interface{}{"message": "Subscription is already active", "statusCode": 400, "code": "DUPLICATE_SUBSCRIPTION"}})
+		return
+	}
+	defer subscriptions.finish(id, done)
+
+	var subscriptionContext map[string]interface{}
+	capture := func(body map[string]interface{}, context *map[string]interface{}) {
+		subscriptionContext = *context
+	}
+	handler := append(append([]interface{}{}, p.handler...), capture)
+	if result := <-routeReducer(handler, p.request, p.context, p.timeout); result[3] != nil {
+		emit(result)
+		return
+	}
+
+	body, _ := p.request.Body.(map[string]interface{})
+	headers, _ := p.request.Headers.(map[string]interface{})
+	selector, _ := headers["_s"].([]interface{})
+
+	var mu sync.Mutex
+	ended := false
+	emitValue := func(value interface{}) error {
+		if value == nil {
+			return errors.New("subscription values should not be nil")
+		}
+		if object, ok := value.(map[string]interface{}); ok && selector != nil {
+			value = filterObject(object, selector)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		select {
+		case <-done:
+			return errors.New("subscription is closed")
+		default:
+		}
+		if ended {
+			return errors.New("subscription is closed")
+		}
+		emit([4]interface{}{id, route, value, nil})
+		return nil
+	}
+
+	err := subscription(body, subscriptionContext, emitValue, done)
+
+	mu.Lock()
+	defer mu.Unlock()
+	ended = true
+	if err != nil {
+		errorObject := map[string]interface{}{"message": err.Error(), "statusCode": 500}
+		if blestErr, ok := err.(*BlestError); ok {
+			errorObject["statusCode"] = blestErr.StatusCode
+			if blestErr.Code != "" {
+				errorObject["code"] = blestErr.Code
+			}
+		}
+		emit([4]interface{}{id, route, nil, errorObject})
+	} else {
+		emit([4]interface{}{id, route, nil, nil})
+	}
+}
+
+// Subscription delivers the values of a server-side subscription. Values is
+// closed when the stream ends, after which Err reports why.
+type Subscription struct {
+	Values <-chan interface{}
+	values chan interface{}
+	mu     sync.Mutex
+	queue  []interface{}
+	err    error
+	ended  bool
+	wake   chan struct{}
+	stop   chan struct{}
+	once   sync.Once
+	cancel func()
+}
+
+func newSubscription(cancel func()) *Subscription {
+	values := make(chan interface{})
+	s := &Subscription{
+		Values: values,
+		values: values,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		cancel: cancel,
+	}
+	go s.pump()
+	return s
+}
+
+func (s *Subscription) push(value interface{}) {
+	s.mu.Lock()
+	if !s.ended {
+		s.queue = append(s.queue, value)
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *Subscription) end(err error) {
+	s.mu.Lock()
+	if !s.ended {
+		s.ended = true
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *Subscription) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pump forwards queued values to the Values channel so that a slow consumer
+// never blocks the connection the values arrive on.
+func (s *Subscription) pump() {
+	defer close(s.values)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			ended := s.ended
+			s.mu.Unlock()
+			if ended {
+				return
+			}
+			select {
+			case <-s.wake:
+			case <-s.stop:
+				return
+			}
+			continue
+		}
+		value := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		select {
+		case s.values <- value:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Unsubscribe cancels the subscription and closes Values without waiting for
+// the consumer to drain it.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.end(nil)
+		close(s.stop)
+		if s.cancel != nil {
+			s.cancel()
+		}
+	})
+}
+
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Subscribe opens a server-sent event stream, or an in-process stream, for a
+// subscription route. The stream is closed when the server ends it or
+// Unsubscribe is called.
+func (c *HttpClient) Subscribe(route string, args ...interface{}) (*Subscription, error) {
+	body, headers, err := parseRequestArgs(route, args)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, ok := c.transport.(subscribeTransport)
+	if !ok {
+		return nil, errSubscriptionsUnsupported
+	}
+
+	id := uuid.New().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	subscription := newSubscription(cancel)
+
+	go func() {
+		ended := false
+		err := transport.subscribe(ctx, [][]interface{}{{id, route, body, headers}}, c.HttpHeaders, func(r []interface{}) {
+			if ended || len(r) < 4 || r[0] != id {
+				return
+			}
+			ended = deliverSubscriptionValue(subscription, r)
+		})
+		if ended || ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("subscription stream ended unexpectedly")
+		}
+		subscription.end(err)
+	}()
+
+	return subscription, nil
+}
+
+// Subscribe starts a subscription on the shared connection. Active
+// subscriptions are restarted after a reconnection.
+func (c *WebSocketClient) Subscribe(route string, args ...interface{}) (*Subscription, error) {
+	body, headers, err := parseRequestArgs(route, args)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errors.New("client is closed")
+	}
+	id := uuid.New().String()
+	subscription := newSubscription(func() {
+		c.unsubscribe(id)
+	})
+	c.subscriptions[id] = subscription
+	c.Queue = append(c.Queue, []interface{}{id, route, body, headers})
+	if c.Timeout == nil {
+		c.Timeout = time.AfterFunc(1*time.Millisecond, c.Process)
+	}
+	return subscription, nil
+}
+
+func (c *WebSocketClient) unsubscribe(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.subscriptions[id]; !exists {
+		return
+	}
+	delete(c.subscriptions, id)
+	for i, r := range c.Queue {
+		if r[0].(string) == id {
+			c.Queue = append(c.Queue[:i:i], c.Queue[i+1:]...)
+			return
+		}
+	}
+	delete(c.inFlight, id)
+	if c.closed {
+		return
+	}
+	c.Queue = append(c.Queue, []interface{}{uuid.New().String(), "_unsubscribe", map[string]interface{}{"id": id}, nil})
+	if c.Timeout == nil {
+		c.Timeout = time.AfterFunc(1*time.Millisecond, c.Process)
+	}
+}
+
+// deliverSubscriptionValue passes a result tuple on to a subscription and
+// reports whether it ended the stream.
+func deliverSubscriptionValue(subscription *Subscription, r []interface{}) bool {
+	if errVal, ok := r[3].(map[string]interface{}); ok {
+		subscription.end(blestErrorFromMap(errVal, 500))
+		return true
+	} else if r[2] == nil {
+		subscription.end(nil)
+		return true
+	}
+	subscription.push(r[2])
+	return false
+}
@@ -0,0 +1,122 @@
+package blest
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collectValues(t *testing.T, subscription *Subscription) []interface{} {
+	values := []interface{}{}
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case value, ok := <-subscription.Values:
+			if !ok {
+				return values
+			}
+			values = append(values, value)
+		case <-timeout:
+			t.Fatal("subscription did not end")
+			return values
+		}
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	t.Parallel()
+
+	tickerStopped := make(chan string, 4)
+
+	router := NewRouter(map[string]interface{}{"websocket": true})
+	router.Use(func(body map[string]interface{}, context *map[string]interface{}) {
+		(*context)["user"] = "steve"
+	})
+	router.Route("basicRoute", func(body map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"hello": "world"}, nil
+	})
+	router.Subscribe("counter", func(body map[string]interface{}, context map[string]interface{}, emit func(interface{}) error, done <-chan struct{}) error {
+		count := int(body["count"].(float64))
+		for i := 1; i <= count; i++ {
+			if err := emit(map[string]interface{}{"count": float64(i), "user": context["user"]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	router.Subscribe("ticker", func(body map[string]interface{}, context map[string]interface{}, emit func(interface{}) error, done <-chan struct{}) error {
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				emit(map[string]interface{}{"tick": true})
+			case <-done:
+				tickerStopped <- context["requestId"].(string)
+				return nil
+			}
+		}
+	})
+	router.Subscribe("failing", func(body map[string]interface{}, context map[string]interface{}, emit func(interface{}) error, done <-chan struct{}) error {
+		emit(map[string]interface{}{"ok": true})
+		return NewBlestError("Gone", 410, "GONE")
+	})
+
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+
+	// Subscriptions need a persistent connection
+	result, reqErr := router.Handle([][]interface{}{{"a", "counter", map[string]interface{}{"count": 1.0}}}, nil)
+	assert.Nil(t, reqErr)
+	assert.Equal(t, "SUBSCRIPTIONS_UNSUPPORTED", result[0][3].(map[string]interface{})["code"])
+
+	clients := map[string]interface {
+		Subscribe(route string, args ...interface{}) (*Subscription, error)
+	}{
+		"http":      NewHttpClient(server.URL),
+		"websocket": NewWebSocketClient(server.URL),
+	}
+
+	for name, client := range clients {
+		// Values arrive in order and the channel closes when the stream ends
+		subscription, err := client.Subscribe("counter", map[string]interface{}{"count": 3.0}, map[string]interface{}{"_s": []interface{}{"count"}})
+		assert.Nil(t, err, name)
+		values := collectValues(t, subscription)
+		assert.Equal(t, []interface{}{
+			map[string]interface{}{"count": 1.0},
+			map[string]interface{}{"count": 2.0},
+			map[string]interface{}{"count": 3.0},
+		}, values, name)
+		assert.Nil(t, subscription.Err(), name)
+
+		// Middleware runs before the subscription handler
+		subscription, _ = client.Subscribe("counter", map[string]interface{}{"count": 1.0})
+		values = collectValues(t, subscription)
+		assert.Equal(t, "steve", values[0].(map[string]interface{})["user"], name)
+
+		// Errors end the stream
+		subscription, _ = client.Subscribe("failing", nil)
+		values = collectValues(t, subscription)
+		assert.Equal(t, 1, len(values), name)
+		blestErr, ok := subscription.Err().(*BlestError)
+		assert.True(t, ok, name)
+		assert.Equal(t, 410, blestErr.StatusCode, name)
+		assert.Equal(t, "GONE", blestErr.Code, name)
+
+		// Unsubscribing stops the server-side handler
+		subscription, _ = client.Subscribe("ticker", nil)
+		<-subscription.Values
+		<-subscription.Values
+		subscription.Unsubscribe()
+		collectValues(t, subscription)
+		select {
+		case <-tickerStopped:
+		case <-time.After(2 * time.Second):
+			t.Fatal("ticker subscription was not stopped: " + name)
+		}
+	}
+
+	clients["websocket"].(*WebSocketClient).Close()
+}
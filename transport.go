@@ -0,0 +1,134 @@
+package blest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Transport delivers a batch to a server and calls respond with each result
+// tuple it receives. A batch-level failure is returned as a *BlestError.
+type Transport interface {
+	Send(requests [][]interface{}, headers map[string]string, respond func([]interface{})) error
+}
+
+// TransportFunc adapts a function to the Transport interface.
+type TransportFunc func(requests [][]interface{}, headers map[string]string, respond func([]interface{})) error
+
+func (f TransportFunc) Send(requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	return f(requests, headers, respond)
+}
+
+// subscribeTransport is implemented by transports that can keep a batch open,
+// which subscriptions require. The stream ends when ctx is cancelled.
+type subscribeTransport interface {
+	subscribe(ctx context.Context, requests [][]interface{}, headers map[string]string, respond func([]interface{})) error
+}
+
+var errSubscriptionsUnsupported = errors.New("transport does not support subscriptions")
+
+// RouterTransport sends batches straight to a router in the same process.
+// Batches and results are still encoded and decoded with Codec so that
+// handlers and callers see the same values they would over the network.
+type RouterTransport struct {
+	Router *Router
+	Codec  Codec
+}
+
+func NewRouterTransport(router *Router) *RouterTransport {
+	if router == nil {
+		panic("Router is required")
+	}
+	return &RouterTransport{
+		Router: router,
+		Codec:  findCodec(parseCodecs(router.Options), "application/json"),
+	}
+}
+
+func (t *RouterTransport) Send(requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	data, err := t.roundTrip(requests)
+	if err != nil {
+		return err
+	}
+	result, reqErr := t.Router.Handle(data, routerTransportContext(headers))
+	if reqErr != nil {
+		return blestErrorFromMap(reqErr, 500)
+	}
+	for _, item := range result {
+		decoded, err := t.roundTripResult(item)
+		if err != nil {
+			return err
+		}
+		respond(decoded)
+	}
+	return nil
+}
+
+func (t *RouterTransport) subscribe(ctx context.Context, requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+	data, err := t.roundTrip(requests)
+	if err != nil {
+		return err
+	}
+	subscriptions := newSubscriptionSet()
+	context := routerTransportContext(headers)
+	context[subscriptionsContextKey] = subscriptions
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		subscriptions.closeAll()
+	}()
+	var resultErr error
+	reqErr := t.Router.HandleStream(data, context, func(result [4]interface{}) {
+		if resultErr != nil {
+			return
+		}
+		decoded, err := t.roundTripResult(result)
+		if err != nil {
+			resultErr = err
+			return
+		}
+		respond(decoded)
+	})
+	if reqErr != nil {
+		return blestErrorFromMap(reqErr, 500)
+	}
+	return resultErr
+}
+
+func (t *RouterTransport) roundTrip(requests [][]interface{}) ([][]interface{}, error) {
+	body, err := t.Codec.Marshal(requests)
+	if err != nil {
+		return nil, err
+	}
+	var data [][]interface{}
+	if err := t.Codec.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (t *RouterTransport) roundTripResult(result [4]interface{}) ([]interface{}, error) {
+	body, err := t.Codec.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	var decoded []interface{}
+	if err := t.Codec.Unmarshal(body, &decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+func routerTransportContext(headers map[string]string) map[string]interface{} {
+	httpHeaders := http.Header{}
+	for key, value := range headers {
+		httpHeaders.Set(key, value)
+	}
+	return map[string]interface{}{
+		"headers": httpHeaders,
+	}
+}
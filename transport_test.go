@@ -0,0 +1,144 @@
+package blest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouterTransport(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter(map[string]interface{}{"maxBatchSize": 5})
+	router.Use(func(body map[string]interface{}, context *map[string]interface{}) {
+		headers, _ := (*context)["headers"].(map[string]interface{})
+		(*context)["user"] = headers["user"]
+	})
+	router.Route("greet", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"hello": body["name"], "user": context["user"], "extra": true}, nil
+	})
+	router.Route("fail", func() (interface{}, error) {
+		return nil, NewBlestError("Nope", 418, "TEAPOT")
+	})
+	router.Subscribe("count", func(body map[string]interface{}, context map[string]interface{}, emit func(interface{}) error, done <-chan struct{}) error {
+		for i := 1; i <= 3; i++ {
+			emit(map[string]interface{}{"count": i})
+		}
+		return nil
+	})
+
+	client := NewHttpClient("", map[string]interface{}{"transport": NewRouterTransport(router)})
+
+	// Requests are batched and go through middleware, selectors and codecs
+	var wg sync.WaitGroup
+	results := make([]map[string]interface{}, 5)
+	errs := make([]error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = client.Request("greet", map[string]interface{}{"name": "world"}, map[string]interface{}{"user": "steve", "_s": []interface{}{"hello", "user"}})
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, errs[i])
+		assert.Equal(t, map[string]interface{}{"hello": "world", "user": "steve"}, results[i])
+	}
+
+	_, err := client.Request("fail")
+	blestErr, ok := err.(*BlestError)
+	assert.True(t, ok)
+	assert.Equal(t, 418, blestErr.StatusCode)
+	assert.Equal(t, "TEAPOT", blestErr.Code)
+
+	_, err = client.Request("missing")
+	assert.Equal(t, 404, err.(*BlestError).StatusCode)
+
+	// Batch errors are returned as they would be over HTTP
+	err = NewRouterTransport(router).Send(make([][]interface{}, 6), nil, func([]interface{}) {})
+	assert.Equal(t, "BATCH_TOO_LARGE", err.(*BlestError).Code)
+
+	subscription, err := client.Subscribe("count")
+	assert.Nil(t, err)
+	values := collectValues(t, subscription)
+	assert.Len(t, values, 3)
+	assert.Equal(t, float64(3), values[2].(map[string]interface{})["count"])
+	assert.Nil(t, subscription.Err())
+
+	assert.Panics(t, func() {
+		NewRouterTransport(nil)
+	})
+}
+
+type countingRoundTripper struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (c *countingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.count++
+	c.mu.Unlock()
+	request.Header.Set("X-Injected", "yes")
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+func TestHttpClientInjection(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter()
+	router.Route("injected", func(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"injected": true}, nil
+	})
+	handler := router.HttpHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Injected") != "yes" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// Every batch goes through the injected client
+	roundTripper := &countingRoundTripper{}
+	client := NewHttpClient(server.URL, map[string]interface{}{
+		"httpClient": &http.Client{Transport: roundTripper, Timeout: 2 * time.Second},
+	})
+	for i := 0; i < 3; i++ {
+		result, err := client.Request("injected")
+		assert.Nil(t, err)
+		assert.Equal(t, true, result["injected"])
+	}
+	roundTripper.mu.Lock()
+	assert.Equal(t, 3, roundTripper.count)
+	roundTripper.mu.Unlock()
+
+	_, err := NewHttpClient(server.URL).Request("injected")
+	assert.Equal(t, 403, err.(*BlestError).StatusCode)
+
+	// Any Transport can replace HTTP entirely
+	client = NewHttpClient("", map[string]interface{}{
+		"transport": TransportFunc(func(requests [][]interface{}, headers map[string]string, respond func([]interface{})) error {
+			for _, request := range requests {
+				respond([]interface{}{request[0], request[1], map[string]interface{}{"custom": true}, nil})
+			}
+			return nil
+		}),
+	})
+	result, err := client.Request("anything")
+	assert.Nil(t, err)
+	assert.Equal(t, true, result["custom"])
+
+	_, err = client.Subscribe("anything")
+	assert.Equal(t, errSubscriptionsUnsupported, err)
+
+	assert.Panics(t, func() {
+		NewHttpTransport(server.URL, map[string]interface{}{"httpClient": http.DefaultTransport})
+	})
+}
@@ -0,0 +1,223 @@
+package blest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ProtocolVersion is the version of the batch protocol spoken by this
+// package. Clients send it in the Blest-Version header, and servers reject
+// versions they do not support.
+const ProtocolVersion = 1
+
+const versionHeader = "Blest-Version"
+
+const capabilitiesContextKey = "capabilities"
+
+var supportedVersions = []int{ProtocolVersion}
+
+// checkVersion accepts requests without a version, which predate the header,
+// and requests with a supported version.
+func checkVersion(header string) *BlestError {
+	if header == "" {
+		return nil
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(header))
+	if err == nil {
+		for _, supported := range supportedVersions {
+			if version == supported {
+				return nil
+			}
+		}
+	}
+	return &BlestError{Message: fmt.Sprintf("Protocol version %s is not supported, supported versions are %s", header, joinVersions(supportedVersions)), StatusCode: 400, Code: "UNSUPPORTED_VERSION"}
+}
+
+func joinVersions(versions []int) string {
+	parts := make([]string, len(versions))
+	for i, version := range versions {
+		parts[i] = strconv.Itoa(version)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// baseCapabilities describes the features every server supports, whatever
+// carries its batches.
+func baseCapabilities() map[string]interface{} {
+	versions := make([]interface{}, len(supportedVersions))
+	for i, version := range supportedVersions {
+		versions[i] = version
+	}
+	return map[string]interface{}{
+		"versions":      versions,
+		"notifications": true,
+		"references":    true,
+	}
+}
+
+// httpCapabilities describes what an HTTP handler accepts, for the
+// _capabilities system route.
+func httpCapabilities(codecs []Codec, compression compressionConfig, encryption *encryptionConfig, signing *signingConfig, limits requestLimits, cacheable bool, websocketEnabled bool) map[string]interface{} {
+	capabilities := baseCapabilities()
+	contentTypes := make([]interface{}, len(codecs))
+	for i, codec := range codecs {
+		contentTypes[i] = codec.ContentType()
+	}
+	capabilities["codecs"] = contentTypes
+	encodings := []interface{}{}
+	if compression.enabled {
+		for _, encoder := range compression.encoders {
+			encodings = append(encodings, encoder.Encoding())
+		}
+	}
+	capabilities["compression"] = encodings
+	capabilities["streaming"] = []interface{}{ndjsonContentType, sseContentType}
+	capabilities["encryption"] = encryption != nil
+	capabilities["encryptionRequired"] = encryption != nil && encryption.required
+	capabilities["signatureRequired"] = signing != nil
+	capabilities["cacheable"] = cacheable
+	capabilities["websocket"] = websocketEnabled
+	capabilities["maxBatchSize"] = limits.maxBatchSize
+	capabilities["maxBodySize"] = int(limits.maxBodySize)
+	return capabilities
+}
+
+// describeCapabilities handles the _capabilities system route, which
+// describes the protocol versions and features the server supports.
+func describeCapabilities(body map[string]interface{}, context map[string]interface{}) (interface{}, error) {
+	if described, ok := context[capabilitiesContextKey].(map[string]interface{}); ok {
+		return described, nil
+	}
+	return baseCapabilities(), nil
+}
+
+func errCapabilityMismatch(message string) error {
+	return &BlestError{Message: message, StatusCode: 400, Code: "CAPABILITY_MISMATCH"}
+}
+
+// Capabilities asks the server which protocol versions and features it
+// supports. Servers that predate the _capabilities system route answer with
+// a CAPABILITIES_UNSUPPORTED error.
+func (c *HttpClient) Capabilities() (map[string]interface{}, error) {
+	var result map[string]interface{}
+	var itemErr error
+	err := c.send([][]interface{}{{"capabilities", "_capabilities"}}, func(r []interface{}) {
+		result, itemErr = itemResult(r[2], r[3])
+	})
+	return checkCapabilities(result, itemErr, err)
+}
+
+func checkCapabilities(result map[string]interface{}, itemErr error, err error) (map[string]interface{}, error) {
+	if err == nil {
+		err = itemErr
+	}
+	if blestErr, ok := err.(*BlestError); ok && blestErr.StatusCode == 404 {
+		return nil, &BlestError{Message: "The server does not describe its capabilities", StatusCode: 404, Code: "CAPABILITIES_UNSUPPORTED"}
+	} else if err != nil {
+		return nil, err
+	} else if result == nil {
+		return nil, errors.New("no response for capabilities")
+	}
+	return result, nil
+}
+
+// negotiation holds the outcome of the capabilities handshake of an HTTP
+// transport, which runs before its first batch.
+type negotiation struct {
+	mu   sync.Mutex
+	done bool
+	err  error
+}
+
+// negotiate asks the server for its capabilities with a plain JSON request,
+// then falls back to what the server supports. Requirements that cannot be
+// met on either side fail every batch with a clear error, while a failed
+// handshake is tried again with the next batch. Servers that do not describe
+// their capabilities are used as configured.
+func (t *httpTransport) negotiate() error {
+	t.negotiation.mu.Lock()
+	defer t.negotiation.mu.Unlock()
+	if t.negotiation.done {
+		return t.negotiation.err
+	}
+	plain := &httpTransport{
+		url:        t.url,
+		client:     t.client,
+		codecs:     t.codecs,
+		encryption: t.encryption,
+		signer:     t.signer,
+	}
+	var result map[string]interface{}
+	var itemErr error
+	err := plain.post(context.Background(), [][]interface{}{{"capabilities", "_capabilities"}}, nil, JSONCodec{}.ContentType(), func(r []interface{}) {
+		result, itemErr = itemResult(r[2], r[3])
+	})
+	result, err = checkCapabilities(result, itemErr, err)
+	if blestErr, ok := err.(*BlestError); ok && blestErr.Code == "CAPABILITIES_UNSUPPORTED" {
+		t.negotiation.done = true
+		return nil
+	} else if blestErr, ok := err.(*BlestError); ok && blestErr.Code == "UNSUPPORTED_VERSION" {
+		t.negotiation.done, t.negotiation.err = true, err
+		return err
+	} else if err != nil {
+		return err
+	}
+	t.negotiation.done, t.negotiation.err = true, t.adapt(result)
+	return t.negotiation.err
+}
+
+func (t *httpTransport) adapt(capabilities map[string]interface{}) error {
+	versions, _ := capabilities["versions"].([]interface{})
+	compatible := false
+	for _, version := range versions {
+		if v, ok := intValue(version); ok && v == ProtocolVersion {
+			compatible = true
+		}
+	}
+	if !compatible {
+		return &BlestError{Message: fmt.Sprintf("The server does not support protocol version %d", ProtocolVersion), StatusCode: 400, Code: "UNSUPPORTED_VERSION"}
+	}
+
+	encryption, _ := capabilities["encryption"].(bool)
+	encryptionRequired, _ := capabilities["encryptionRequired"].(bool)
+	signatureRequired, _ := capabilities["signatureRequired"].(bool)
+	if t.encryption != nil && !encryption {
+		return errCapabilityMismatch("The server does not support encrypted requests")
+	} else if t.encryption == nil && encryptionRequired {
+		return errCapabilityMismatch("The server requires encrypted requests")
+	} else if t.signer == nil && signatureRequired {
+		return errCapabilityMismatch("The server requires signed requests")
+	}
+
+	if codecs, ok := capabilities["codecs"].([]interface{}); ok && t.codec != nil && !containsValue(codecs, t.codec.ContentType()) {
+		t.codec = t.jsonCodec()
+	}
+	if encodings, ok := capabilities["compression"].([]interface{}); ok {
+		if len(encodings) == 0 {
+			t.compression.enabled = false
+			t.compression.request = nil
+		} else if t.compression.request != nil && !containsValue(encodings, t.compression.request.Encoding()) {
+			t.compression.request = nil
+		}
+	}
+	if streaming, ok := capabilities["streaming"].([]interface{}); ok && !containsValue(streaming, ndjsonContentType) {
+		t.stream = false
+	}
+	if cacheable, _ := capabilities["cacheable"].(bool); !cacheable {
+		t.cacheableRoutes = nil
+	}
+	return nil
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package blest
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProtocolVersion(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter(map[string]interface{}{"compression": false})
+	router.Route("ping", func() (interface{}, error) {
+		return map[string]interface{}{"pong": true}, nil
+	})
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+
+	post := func(version string) *http.Response {
+		request, _ := http.NewRequest("POST", server.URL, bytes.NewBufferString(`[["1","ping"]]`))
+		request.Header.Set("Content-Type", "application/json")
+		if version != "" {
+			request.Header.Set("Blest-Version", version)
+		}
+		response, err := http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		response.Body.Close()
+		return response
+	}
+
+	// Requests without a version predate the header, and unknown versions
+	// are rejected
+	assert.Equal(t, http.StatusOK, post("").StatusCode)
+	assert.Equal(t, http.StatusOK, post("1").StatusCode)
+	response := post("2")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+	assert.Equal(t, "1", response.Header.Get("Blest-Version"))
+	assert.Equal(t, "UNSUPPORTED_VERSION", checkVersion("2").Code)
+	assert.Equal(t, "Protocol version x is not supported, supported versions are 1", checkVersion("x").Message)
+
+	// The server describes its capabilities through a system route
+	client := NewHttpClient(server.URL)
+	capabilities, err := client.Capabilities()
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{1.0}, capabilities["versions"])
+	assert.Equal(t, []interface{}{}, capabilities["compression"])
+	assert.Contains(t, capabilities["codecs"], "application/msgpack")
+	assert.Equal(t, false, capabilities["encryption"])
+	assert.Equal(t, true, capabilities["references"])
+
+	result, reqErr := router.Handle([][]interface{}{{"1", "_capabilities"}}, map[string]interface{}{})
+	assert.Nil(t, reqErr)
+	assert.Equal(t, true, result[0][2].(map[string]interface{})["notifications"])
+}
+
+type textCodec struct {
+	JSONCodec
+}
+
+func (textCodec) ContentType() string {
+	return "text/x-blest"
+}
+
+func TestNegotiation(t *testing.T) {
+	t.Parallel()
+
+	router := NewRouter(map[string]interface{}{"compression": false})
+	router.Route("ping", func() (interface{}, error) {
+		return map[string]interface{}{"pong": true}, nil
+	})
+	var posts atomic.Int32
+	handler := router.HttpHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// The client drops features the server does not support, once
+	client := NewHttpClient(server.URL, map[string]interface{}{
+		"negotiate":            true,
+		"compression":          "deflate",
+		"compressionThreshold": 0,
+		"codec":                textCodec{},
+	})
+	for i := 0; i < 2; i++ {
+		result, err := client.Request("ping")
+		assert.Nil(t, err)
+		assert.Equal(t, true, result["pong"])
+	}
+	assert.Equal(t, int32(3), posts.Load())
+	transport := client.transport.(*httpTransport)
+	assert.Nil(t, transport.compression.request)
+	assert.False(t, transport.compression.enabled)
+	assert.Equal(t, "application/json", transport.codec.ContentType())
+
+	// Requirements that cannot be met fail with a clear error
+	signed := NewRouter(map[string]interface{}{"signingKeys": map[string][]byte{"a": bytes.Repeat([]byte("k"), 32)}})
+	signedServer := httptest.NewServer(signed.HttpHandler())
+	defer signedServer.Close()
+	_, err := NewHttpClient(signedServer.URL, map[string]interface{}{"negotiate": true}).Request("ping")
+	assert.Equal(t, "SIGNATURE_REQUIRED", err.(*BlestError).Code)
+
+	newer := httptest.NewServer(NewHttpHandler(func(requests [][]interface{}, context map[string]interface{}) ([][4]interface{}, map[string]interface{}) {
+		return [][4]interface{}{{requests[0][0], requests[0][1], map[string]interface{}{"versions": []interface{}{2}}, nil}}, nil
+	}))
+	defer newer.Close()
+	_, err = NewHttpClient(newer.URL, map[string]interface{}{"negotiate": true}).Request("ping")
+	assert.Equal(t, "UNSUPPORTED_VERSION", err.(*BlestError).Code)
+	assert.Equal(t, "The server does not support protocol version 1", err.Error())
+
+	transport = &httpTransport{encryption: &clientEncryption{}}
+	err = transport.adapt(map[string]interface{}{"versions": []interface{}{1.0}})
+	assert.Equal(t, "The server does not support encrypted requests", err.Error())
+	transport = &httpTransport{}
+	err = transport.adapt(map[string]interface{}{"versions": []interface{}{1.0}, "signatureRequired": true})
+	assert.Equal(t, "CAPABILITY_MISMATCH", err.(*BlestError).Code)
+
+	// Servers that predate capabilities are used as configured
+	legacy := httptest.NewServer(NewHttpHandler(func(requests [][]interface{}, context map[string]interface{}) ([][4]interface{}, map[string]interface{}) {
+		results := make([][4]interface{}, len(requests))
+		for i, request := range requests {
+			if request[1] == "_capabilities" {
+				results[i] = [4]interface{}{request[0], request[1], nil, map[string]interface{}{"message": "Not Found", "statusCode": 404}}
+			} else {
+				results[i] = [4]interface{}{request[0], request[1], map[string]interface{}{"legacy": true}, nil}
+			}
+		}
+		return results, nil
+	}))
+	defer legacy.Close()
+	legacyClient := NewHttpClient(legacy.URL, map[string]interface{}{"negotiate": true})
+	result, err := legacyClient.Request("ping")
+	assert.Nil(t, err)
+	assert.Equal(t, true, result["legacy"])
+	_, err = legacyClient.Capabilities()
+	assert.Equal(t, "CAPABILITIES_UNSUPPORTED", err.(*BlestError).Code)
+}
@@ -0,0 +1,439 @@
+package blest
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	websocketWriteWait    = 10 * time.Second
+	websocketPongWait     = 60 * time.Second
+	websocketPingInterval = 30 * time.Second
+	maxReconnectDelay     = 5 * time.Second
+)
+
+type WebSocketClient struct {
+	Url            string
+	Options        map[string]interface{}
+	HttpHeaders    map[string]string
+	MaxBatchSize   int
+	Queue          [][]interface{}
+	Timeout        *time.Timer
+	Emitter        *eventEmitter
+	mu             sync.Mutex
+	conn           *websocket.Conn
+	inFlight       map[string][]interface{}
+	subscriptions  map[string]*Subscription
+	connecting     bool
+	closed         bool
+	reconnectDelay time.Duration
+	requestTimeout time.Duration
+	codec          Codec
+}
+
+func websocketOriginChecker(allowOrigin string) func(r *http.Request) bool {
+	if allowOrigin == "" {
+		return nil
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return allowOrigin == "*" || origin == "" || origin == allowOrigin
+	}
+}
+
+// serveWebSocket upgrades the connection and treats every text frame as a
+// batch. Each result tuple is written back as its own frame once ready, and
+// batches beyond the connection's limit are rejected.
+func serveWebSocket(w http.ResponseWriter, r *http.Request, streamHandler StreamHandler, codec Codec, limits requestLimits, checkOrigin func(r *http.Request) bool) {
+	upgrader := websocket.Upgrader{CheckOrigin: checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	if limits.maxBodySize > 0 {
+		conn.SetReadLimit(limits.maxBodySize)
+	}
+	conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+	})
+
+	var writeMu sync.Mutex
+	write := func(v interface{}) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+		conn.WriteJSON(v)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(websocketPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteWait)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	subscriptions := newSubscriptionSet()
+	defer subscriptions.closeAll()
+
+	context := map[string]interface{}{
+		"headers":               r.Header,
+		subscriptionsContextKey: subscriptions,
+	}
+
+	var slots chan struct{}
+	if limits.maxConcurrentBatches > 0 {
+		slots = make(chan struct{}, limits.maxConcurrentBatches)
+	}
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println(err)
+			}
+			return
+		}
+
+		var data [][]interface{}
+		if err := codec.Unmarshal(message, &data); err != nil {
+			write(map[string]interface{}{"message": "Failed to parse request body", "statusCode": 400, "code": "INVALID_JSON"})
+			continue
+		}
+
+		if limitErr := limits.check(data); limitErr != nil {
+			_, reqErr := handleError(limitErr.StatusCode, limitErr.Code, limitErr.Message)
+			writeBatchError(data, reqErr, write)
+			continue
+		}
+
+		// Unsubscribing is always allowed, since subscriptions hold their
+		// batch open until they end
+		limited := slots != nil && !onlyUnsubscribes(data)
+		if limited {
+			select {
+			case slots <- struct{}{}:
+			default:
+				_, reqErr := handleError(429, "TOO_MANY_BATCHES", fmt.Sprintf("Connection should run at most %d batches at once", limits.maxConcurrentBatches))
+				writeBatchError(data, reqErr, write)
+				continue
+			}
+		}
+
+		go func(data [][]interface{}) {
+			if limited {
+				defer func() { <-slots }()
+			}
+			reqErr := streamHandler(data, context, func(result [4]interface{}) {
+				write(result)
+			})
+			if reqErr != nil {
+				writeBatchError(data, reqErr, write)
+			}
+		}(data)
+	}
+}
+
+func onlyUnsubscribes(data [][]interface{}) bool {
+	for _, request := range data {
+		if len(request) < 2 || request[1] != "_unsubscribe" {
+			return false
+		}
+	}
+	return len(data) > 0
+}
+
+// writeBatchError reports a batch-level error against every item that can
+// be identified, since frames on a shared connection carry no batch ID.
+func writeBatchError(data [][]interface{}, reqErr map[string]interface{}, write func(interface{})) {
+	written := false
+	for _, request := range data {
+		if len(request) < 2 {
+			continue
+		}
+		id, ok := request[0].(string)
+		if !ok || id == "" {
+			continue
+		}
+		write([4]interface{}{id, request[1], nil, reqErr})
+		written = true
+	}
+	if !written {
+		write(reqErr)
+	}
+}
+
+func NewWebSocketClient(url string, args ...interface{}) *WebSocketClient {
+	var options map[string]interface{}
+	var httpHeaders map[string]string
+	if len(args) > 0 {
+		o, oOk := args[0].(map[string]interface{})
+		if oOk && o != nil {
+			options = o
+			h, hOk := o["httpHeaders"].(map[string]string)
+			if hOk && h != nil {
+				httpHeaders = h
+			}
+		}
+	}
+	useNumber, _ := options["useNumber"].(bool)
+	reconnectDelay := 100 * time.Millisecond
+	if options["reconnectDelay"] != nil {
+		d, ok := options["reconnectDelay"].(int)
+		if !ok || d <= 0 {
+			panic("reconnectDelay should be a positive integer")
+		}
+		reconnectDelay = time.Duration(d) * time.Millisecond
+	}
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		url = "ws" + strings.TrimPrefix(url, "http")
+	}
+	client := &WebSocketClient{
+		Url:            url,
+		Options:        options,
+		HttpHeaders:    httpHeaders,
+		MaxBatchSize:   100,
+		Queue:          [][]interface{}{},
+		Emitter:        &eventEmitter{},
+		inFlight:       make(map[string][]interface{}),
+		subscriptions:  make(map[string]*Subscription),
+		reconnectDelay: reconnectDelay,
+		requestTimeout: parseRequestTimeout(options, nil),
+		codec:          JSONCodec{UseNumber: useNumber},
+	}
+	return client
+}
+
+func (c *WebSocketClient) Request(route string, args ...interface{}) (map[string]interface{}, error) {
+	body, headers, err := parseRequestArgs(route, args)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, errors.New("client is closed")
+	}
+	id := uuid.New().String()
+	ch := make(chan interface{}, 1)
+	c.Emitter.once(id, ch)
+	c.Queue = append(c.Queue, []interface{}{id, route, body, headers})
+	if c.Timeout == nil {
+		c.Timeout = time.AfterFunc(1*time.Millisecond, c.Process)
+	}
+	c.mu.Unlock()
+
+	result, err := awaitResponse(ch, c.requestTimeout)
+	c.forget(id)
+	return result, err
+}
+
+// Process sends the next batch from the queue, connecting first if needed.
+// Sent items are kept in flight until answered so that they can be replayed
+// after a reconnection.
+func (c *WebSocketClient) Process() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Timeout != nil {
+		c.Timeout.Stop()
+		c.Timeout = nil
+	}
+	if c.closed || len(c.Queue) == 0 {
+		return
+	}
+	if c.conn == nil {
+		if !c.connecting {
+			c.connecting = true
+			go c.connect()
+		}
+		return
+	}
+	newQueue := c.Queue[:min(len(c.Queue), c.MaxBatchSize)]
+	c.Queue = c.Queue[len(newQueue):]
+	if len(c.Queue) > 0 {
+		c.Timeout = time.AfterFunc(1*time.Millisecond, c.Process)
+	}
+	for _, r := range newQueue {
+		c.inFlight[r[0].(string)] = r
+	}
+	c.writeBatch(newQueue)
+}
+
+func (c *WebSocketClient) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.conn = nil
+	pending := make([]string, 0, len(c.inFlight)+len(c.Queue))
+	for id := range c.inFlight {
+		pending = append(pending, id)
+	}
+	for _, r := range c.Queue {
+		pending = append(pending, r[0].(string))
+	}
+	subscriptions := c.subscriptions
+	c.inFlight = make(map[string][]interface{})
+	c.subscriptions = make(map[string]*Subscription)
+	c.Queue = [][]interface{}{}
+	if c.Timeout != nil {
+		c.Timeout.Stop()
+		c.Timeout = nil
+	}
+	c.mu.Unlock()
+
+	closedErr := errors.New("client is closed")
+	for _, id := range pending {
+		c.Emitter.emit(id, closedErr)
+	}
+	for _, subscription := range subscriptions {
+		subscription.end(closedErr)
+	}
+	if conn == nil {
+		return nil
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(websocketWriteWait))
+	return conn.Close()
+}
+
+// writeBatch must be called with the lock held. A failed write closes the
+// connection, which triggers a reconnection and a replay of the batch.
+func (c *WebSocketClient) writeBatch(batch [][]interface{}) {
+	c.conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+	if err := c.conn.WriteJSON(batch); err != nil {
+		log.Println(err)
+		c.conn.Close()
+	}
+}
+
+func (c *WebSocketClient) connect() {
+	delay := c.reconnectDelay
+	for {
+		httpHeaders := http.Header{}
+		for key, value := range c.HttpHeaders {
+			httpHeaders.Set(key, value)
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(c.Url, httpHeaders)
+
+		c.mu.Lock()
+		if c.closed {
+			c.connecting = false
+			c.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err == nil {
+			c.conn = conn
+			c.connecting = false
+			replay := make([][]interface{}, 0, len(c.inFlight))
+			for _, r := range c.inFlight {
+				replay = append(replay, r)
+			}
+			for len(replay) > 0 {
+				batch := replay[:min(len(replay), c.MaxBatchSize)]
+				replay = replay[len(batch):]
+				c.writeBatch(batch)
+			}
+			if len(c.Queue) > 0 && c.Timeout == nil {
+				c.Timeout = time.AfterFunc(1*time.Millisecond, c.Process)
+			}
+			c.mu.Unlock()
+			go c.readLoop(conn)
+			return
+		}
+		c.mu.Unlock()
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (c *WebSocketClient) readLoop(conn *websocket.Conn) {
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			conn.Close()
+			c.mu.Lock()
+			if c.conn == conn {
+				c.conn = nil
+			}
+			reconnect := !c.closed && !c.connecting && (len(c.inFlight) > 0 || len(c.Queue) > 0)
+			if reconnect {
+				c.connecting = true
+			}
+			c.mu.Unlock()
+			if reconnect {
+				go c.connect()
+			}
+			return
+		}
+
+		var data interface{}
+		if err := c.codec.Unmarshal(message, &data); err != nil {
+			log.Println(err)
+			continue
+		}
+		switch r := data.(type) {
+		case []interface{}:
+			if len(r) < 4 {
+				continue
+			}
+			id, ok := r[0].(string)
+			if !ok {
+				continue
+			}
+			c.mu.Lock()
+			if subscription, exists := c.subscriptions[id]; exists {
+				if deliverSubscriptionValue(subscription, r) {
+					delete(c.subscriptions, id)
+					delete(c.inFlight, id)
+				}
+				c.mu.Unlock()
+				continue
+			}
+			delete(c.inFlight, id)
+			c.mu.Unlock()
+			c.Emitter.emit(id, r[2], r[3])
+		case map[string]interface{}:
+			log.Println(r["message"])
+		}
+	}
+}
+
+func (c *WebSocketClient) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inFlight, id)
+	for i, r := range c.Queue {
+		if r[0].(string) == id {
+			c.Queue = append(c.Queue[:i:i], c.Queue[i+1:]...)
+			break
+		}
+	}
+}
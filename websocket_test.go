@@ -0,0 +1,176 @@
+package blest
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type trackingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *trackingListener) closeConns() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+
+	var slowCalls atomic.Int32
+	router := NewRouter(map[string]interface{}{"websocket": true})
+	router.Route("echoRoute", func(body map[string]interface{}) (interface{}, error) {
+		return body, nil
+	})
+	router.Route("errorRoute", func(body map[string]interface{}) (interface{}, error) {
+		return nil, NewBlestError("Teapot", 418, "TEAPOT")
+	})
+	router.Route("slowRoute", func(body map[string]interface{}) (interface{}, error) {
+		slowCalls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return map[string]interface{}{"done": true}, nil
+	})
+
+	server := httptest.NewUnstartedServer(router.HttpHandler())
+	listener := &trackingListener{Listener: server.Listener}
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	client := NewWebSocketClient(server.URL, map[string]interface{}{"reconnectDelay": 10})
+	defer client.Close()
+
+	// Concurrent requests share the connection
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result, err := client.Request("echoRoute", map[string]interface{}{"index": float64(i)})
+			assert.Nil(t, err)
+			assert.Equal(t, float64(i), result["index"])
+		}(i)
+	}
+	wg.Wait()
+
+	_, err := client.Request("errorRoute", nil)
+	blestErr, ok := err.(*BlestError)
+	assert.True(t, ok)
+	assert.Equal(t, 418, blestErr.StatusCode)
+	assert.Equal(t, "TEAPOT", blestErr.Code)
+
+	// In-flight requests are replayed after a reconnection
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		listener.closeConns()
+	}()
+	result, err := client.Request("slowRoute", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, true, result["done"])
+	assert.Equal(t, int32(2), slowCalls.Load())
+
+	result, err = client.Request("echoRoute", map[string]interface{}{"after": "reconnect"})
+	assert.Nil(t, err)
+	assert.Equal(t, "reconnect", result["after"])
+
+	// Requests fail once the client is closed
+	client.Close()
+	_, err = client.Request("echoRoute", nil)
+	assert.NotNil(t, err)
+}
+
+func TestWebSocketUpgradeChecks(t *testing.T) {
+	t.Parallel()
+
+	dial := func(router *Router, headers http.Header) *http.Response {
+		server := httptest.NewServer(router.HttpHandler())
+		defer server.Close()
+		conn, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), headers)
+		if err == nil {
+			conn.Close()
+		}
+		return response
+	}
+
+	// Upgrades are refused when the server requires encrypted requests
+	encrypted := NewRouter(map[string]interface{}{
+		"websocket":         true,
+		"encryptionKeys":    map[string][]byte{"a": bytes.Repeat([]byte{1}, 32)},
+		"requireEncryption": true,
+	})
+	assert.Equal(t, http.StatusBadRequest, dial(encrypted, nil).StatusCode)
+
+	// and when the protocol version is not supported
+	plain := NewRouter(map[string]interface{}{"websocket": true})
+	assert.Equal(t, http.StatusBadRequest, dial(plain, http.Header{versionHeader: {"2"}}).StatusCode)
+	assert.Equal(t, http.StatusSwitchingProtocols, dial(plain, nil).StatusCode)
+}
+
+func TestWebSocketConcurrentBatches(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	router := NewRouter(map[string]interface{}{"websocket": true, "maxConcurrentBatches": 1})
+	router.Route("wait", func() (interface{}, error) {
+		<-release
+		return map[string]interface{}{"done": true}, nil
+	})
+	server := httptest.NewServer(router.HttpHandler())
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// Batches beyond the limit are rejected while the first one runs, except
+	// for unsubscribing
+	assert.Nil(t, conn.WriteJSON([][]interface{}{{"a", "wait"}}))
+	assert.Nil(t, conn.WriteJSON([][]interface{}{{"b", "wait"}}))
+	assert.Nil(t, conn.WriteJSON([][]interface{}{{"c", "_unsubscribe", map[string]interface{}{"id": "x"}}}))
+	var rejected, unsubscribed []interface{}
+	assert.Nil(t, conn.ReadJSON(&rejected))
+	assert.Equal(t, "b", rejected[0])
+	assert.Equal(t, "TOO_MANY_BATCHES", rejected[3].(map[string]interface{})["code"])
+	assert.Nil(t, conn.ReadJSON(&unsubscribed))
+	assert.Equal(t, "c", unsubscribed[0])
+	assert.Equal(t, "NOT_FOUND", unsubscribed[3].(map[string]interface{})["code"])
+
+	close(release)
+	var done []interface{}
+	assert.Nil(t, conn.ReadJSON(&done))
+	assert.Equal(t, "a", done[0])
+
+	// A slot frees up once a batch completes
+	assert.Eventually(t, func() bool {
+		assert.Nil(t, conn.WriteJSON([][]interface{}{{"d", "wait"}}))
+		var result []interface{}
+		assert.Nil(t, conn.ReadJSON(&result))
+		return result[3] == nil
+	}, time.Second, 10*time.Millisecond)
+}